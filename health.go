@@ -0,0 +1,238 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pzsvc-exec/pzsvc"
+)
+
+// readyTTL is how long a readiness result is reused for.  Some of the checks
+// run commands or call Piazza, which probes shouldn't do every second.
+const readyTTL = 10 * time.Second
+
+// healthCheck is the result of a single check.  Service is blank for checks
+// that apply to the instance as a whole.
+type healthCheck struct {
+	Name		string	`json:"name"`
+	Service		string	`json:"service,omitempty"`
+	OK			bool	`json:"ok"`
+	Detail		string	`json:"detail,omitempty"`
+}
+
+// healthReport is the response to the /health endpoints.
+type healthReport struct {
+	Status		string			`json:"status"`
+	Checked		string			`json:"checked,omitempty"`
+	Checks		[]healthCheck	`json:"checks,omitempty"`
+}
+
+// health runs the readiness checks for an instance, and remembers the
+// latest result.
+type health struct {
+	services	[]*service
+	limiter		*runLimiter
+	minFreeMB	int
+
+	mu			sync.Mutex
+	last		healthReport
+	lastTime	time.Time
+}
+
+func newHealth(services []*service, limiter *runLimiter, minFreeMB int) *health {
+	return &health{services: services, limiter: limiter, minFreeMB: minFreeMB}
+}
+
+// handleLive serves /health/live.  Being able to answer at all is the test.
+func handleLive(w http.ResponseWriter) {
+	printJSON(w, healthReport{Status: "live"})
+}
+
+// handleReady serves /health/ready.  It replies 503 if any check fails, so
+// that the platform can hold back traffic until the instance can do its work.
+func (hl *health) handleReady(w http.ResponseWriter) {
+	report := hl.ready()
+	if report.Status != "ready" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	printJSON(w, report)
+}
+
+// ready runs the checks, or reuses the latest result if it is recent enough.
+// The checks themselves run unlocked, so that a slow one doesn't hold up
+// probes that could have used the previous result.
+func (hl *health) ready() healthReport {
+	hl.mu.Lock()
+	if !hl.lastTime.IsZero() && time.Since(hl.lastTime) < readyTTL {
+		defer hl.mu.Unlock()
+		return hl.last
+	}
+	hl.mu.Unlock()
+
+	var checks []healthCheck
+	for _, svc := range hl.services {
+		checks = append(checks, svc.healthChecks()...)
+	}
+	checks = append(checks, checkDisk(".", hl.minFreeMB), hl.limiter.healthCheck())
+
+	report := healthReport{Status: "ready", Checked: time.Now().UTC().Format(time.RFC3339), Checks: checks}
+	for _, check := range checks {
+		if !check.OK {
+			report.Status = "not ready"
+		}
+	}
+	hl.mu.Lock()
+	hl.last, hl.lastTime = report, time.Now()
+	hl.mu.Unlock()
+	return report
+}
+
+// healthChecks checks what the service depends on: that its command can be
+// found and executed, that its VersionCmd works, and that Piazza is reachable
+// and accepts its auth key.
+func (svc *service) healthChecks() []healthCheck {
+	configObj := svc.configObj
+	name := configObj.SvcName
+
+	cmdCheck := healthCheck{Name: "command", Service: name, OK: true}
+	cmdSlice := splitOrNil(configObj.CliCmd, " ")
+	if cmdSlice == nil {
+		cmdCheck.Detail = "No CliCmd.  Command is given by the caller."
+	} else {
+		// as in execute, a program of that name in the start folder takes
+		// precedence over the PATH.
+		cmdName := cmdSlice[0]
+		if _, err := os.Stat("./" + cmdName); err == nil || !os.IsNotExist(err) {
+			cmdName = "./" + cmdName
+		}
+		cmdPath, err := exec.LookPath(cmdName)
+		if err != nil {
+			cmdCheck.OK = false
+			cmdCheck.Detail = err.Error()
+		} else {
+			cmdCheck.Detail = cmdPath
+		}
+	}
+	checks := []healthCheck{cmdCheck}
+
+	if vCmdSlice := splitOrNil(configObj.VersionCmd, " "); vCmdSlice != nil {
+		vCheck := healthCheck{Name: "versionCmd", Service: name, OK: true}
+		ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+		verB, err := exec.CommandContext(ctx, vCmdSlice[0], vCmdSlice[1:]...).Output()
+		cancel()
+		if err != nil {
+			vCheck.OK = false
+			vCheck.Detail = err.Error()
+		} else {
+			vCheck.Detail = string(verB)
+		}
+		checks = append(checks, vCheck)
+	}
+
+	if svc.canFile && svc.authKey != "" {
+		pzCheck := healthCheck{Name: "piazza", Service: name, OK: true, Detail: configObj.PzAddr}
+		ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+		err := pzsvc.CheckPz(ctx, configObj.PzAddr, svc.authKey)
+		cancel()
+		if err != nil {
+			pzCheck.OK = false
+			pzCheck.Detail = err.Error()
+		}
+		checks = append(checks, pzCheck)
+	}
+	return checks
+}
+
+// checkDisk confirms that the folder runs are done in has at least minFreeMB
+// of space available.
+func checkDisk(dir string, minFreeMB int) healthCheck {
+	check := healthCheck{Name: "disk", OK: true}
+	free, err := freeBytes(dir)
+	if err != nil {
+		check.Detail = "Free space unknown: " + err.Error()
+		return check
+	}
+	freeMB := free / (1024 * 1024)
+	check.Detail = fmt.Sprintf("%d MB free, %d MB required.", freeMB, minFreeMB)
+	check.OK = freeMB >= uint64(minFreeMB)
+	return check
+}
+
+// runLimiter holds the number of concurrent runs within MaxRuns.  Runs
+// beyond that wait their turn.  A nil slots channel means no limit.
+type runLimiter struct {
+	slots		chan struct{}
+	mu			sync.Mutex
+	inFlight	int
+	queued		int
+}
+
+func newRunLimiter(maxRuns int) *runLimiter {
+	rl := &runLimiter{}
+	if maxRuns > 0 {
+		rl.slots = make(chan struct{}, maxRuns)
+	}
+	return rl
+}
+
+// acquire waits for a free slot.  Every acquire must be followed by a release.
+func (rl *runLimiter) acquire() {
+	rl.mu.Lock()
+	rl.queued++
+	rl.mu.Unlock()
+	if rl.slots != nil {
+		rl.slots <- struct{}{}
+	}
+	rl.mu.Lock()
+	rl.queued--
+	rl.inFlight++
+	rl.mu.Unlock()
+}
+
+func (rl *runLimiter) release() {
+	rl.mu.Lock()
+	rl.inFlight--
+	rl.mu.Unlock()
+	if rl.slots != nil {
+		<-rl.slots
+	}
+}
+
+// counts returns the number of runs in flight, and the number waiting.
+func (rl *runLimiter) counts() (int, int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.inFlight, rl.queued
+}
+
+// healthCheck reports the instance as saturated when runs are waiting for
+// a slot.
+func (rl *runLimiter) healthCheck() healthCheck {
+	inFlight, queued := rl.counts()
+	check := healthCheck{Name: "queue", OK: queued == 0}
+	if rl.slots == nil {
+		check.Detail = fmt.Sprintf("%d runs in flight, no limit.", inFlight)
+	} else {
+		check.Detail = fmt.Sprintf("%d of %d runs in flight, %d queued.", inFlight, cap(rl.slots), queued)
+	}
+	return check
+}
@@ -0,0 +1,292 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/venicegeo/pzsvc-exec/pzsvc"
+)
+
+// parseInFiles breaks the entries of the inFiles list into their sources and
+// any caller-specified target filenames.  It returns the sources in order,
+// along with a map of source to target for those entries that had one.
+// Sources listed more than once, and targets requested more than once, are
+// rejected up front, as they could only end in a collision.
+func parseInFiles(entries []string) ([]string, map[string]string, error) {
+	sources := make([]string, 0, len(entries))
+	targets := make(map[string]string)
+	seenSrc := make(map[string]bool)
+	seenTarg := make(map[string]bool)
+	for _, entry := range entries {
+		source, target := splitTarget(entry)
+		if seenSrc[source] {
+			return nil, nil, fmt.Errorf(`Input %s listed more than once.`, source)
+		}
+		seenSrc[source] = true
+		sources = append(sources, source)
+		if target == "" {
+			continue
+		}
+		safeTarg, err := pzsvc.SafeName(target)
+		if err != nil || safeTarg != target || strings.HasPrefix(target, ".") {
+			return nil, nil, fmt.Errorf(`Invalid target filename "%s" for input %s.`, target, source)
+		}
+		if seenTarg[target] {
+			return nil, nil, fmt.Errorf(`Target filename "%s" requested for more than one input.`, target)
+		}
+		seenTarg[target] = true
+		targets[source] = target
+	}
+	return sources, targets, nil
+}
+
+// splitTarget separates an inFiles entry of the form "source:target" into
+// its parts.  Since URL sources contain colons of their own, the final colon
+// only counts as a separator if what follows it is a plain filename, and,
+// for URLs, it comes after the start of the path, with no query or fragment
+// before it.  Colons in a query or fragment are thus always part of the URL.
+func splitTarget(entry string) (string, string) {
+	i := strings.LastIndex(entry, ":")
+	if i <= 0 || i == len(entry)-1 {
+		return entry, ""
+	}
+	source, target := entry[:i], entry[i+1:]
+	if strings.ContainsAny(target, `/\`) {
+		return entry, ""
+	}
+	if j := strings.Index(source, "://"); j >= 0 {
+		if !strings.Contains(source[j+3:], "/") || strings.ContainsAny(source, "?#") {
+			return entry, ""
+		}
+	}
+	return source, target
+}
+
+// fetchInput retrieves a single input into the run folder.  Each input is
+// fetched into a staging folder of its own and then linked into place, so
+// that two inputs resolving to the same filename are caught as a collision
+// rather than silently overwriting each other.  The Piazza metadata of the
+// input is passed on where the fetcher had it.
+func fetchInput(fetchers pzsvc.FetcherSet, source, target, runID string) (string, pzsvc.FileSum, *pzsvc.DataResource, error) {
+	stageDir, err := ioutil.TempDir(runID, ".in-")
+	if err != nil {
+		return "", pzsvc.FileSum{}, nil, err
+	}
+	defer os.RemoveAll(stageDir)
+
+	fName, sum, meta, err := fetchers.FetchMeta(source, stageDir)
+	if err != nil {
+		return "", sum, nil, err
+	}
+	if target == "" {
+		target = fName
+	}
+
+	err = os.Link(filepath.Join(stageDir, fName), filepath.Join(runID, target))
+	if os.IsExist(err) {
+		return "", sum, nil, fmt.Errorf(`Input %s cannot be placed as "%s".  Another input already has that filename.`, source, target)
+	}
+	if err != nil {
+		return "", sum, nil, err
+	}
+	return target, sum, meta, nil
+}
+
+// fillTemplates replaces input placeholders in the command arguments with
+// the local filenames of the corresponding inputs.  "{{in:N}}" refers to the
+// Nth input (counting from zero) and "{{in:<source>}}" to the input with the
+// given dataId or URL.  Substitution happens after the command has been split
+// into arguments, so filenames containing spaces remain single arguments.
+func fillTemplates(cmdSlice, sources []string, inFiles map[string]string) []string {
+	if len(sources) == 0 {
+		return cmdSlice
+	}
+	pairs := make([]string, 0, 4*len(sources))
+	for i, source := range sources {
+		if fName, ok := inFiles[source]; ok {
+			pairs = append(pairs, "{{in:"+strconv.Itoa(i)+"}}", fName, "{{in:"+source+"}}", fName)
+		}
+	}
+	replacer := strings.NewReplacer(pairs...)
+
+	outSlice := make([]string, len(cmdSlice))
+	for i, arg := range cmdSlice {
+		outSlice[i] = replacer.Replace(arg)
+	}
+	return outSlice
+}
+
+// maxFieldBytes caps the combined size of the non-file parts of a multipart
+// request.
+const maxFieldBytes = 1024 * 1024
+
+func isMultipart(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// receiveUploads streams the parts of a multipart/form-data request.  File
+// parts are written into the run folder under their own (sanitized) names,
+// and must total no more than maxBytes.  Other parts are added to the
+// request's form values, so that FormValue works as usual afterwards.  It
+// returns the checksums of the files received, keyed by filename.
+func receiveUploads(r *http.Request, runID string, maxBytes int64) (map[string]pzsvc.FileSum, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	if r.Form == nil {
+		r.Form = make(url.Values)
+	}
+	values := make(map[string][]string)
+	sums := make(map[string]pzsvc.FileSum)
+	remaining := maxBytes
+	fieldRemaining := int64(maxFieldBytes)
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if part.FileName() == "" {
+			valBytes, err := ioutil.ReadAll(io.LimitReader(part, fieldRemaining+1))
+			if err != nil {
+				return nil, err
+			}
+			if int64(len(valBytes)) > fieldRemaining {
+				return nil, fmt.Errorf(`Form fields exceed the limit of %d bytes.`, maxFieldBytes)
+			}
+			fieldRemaining -= int64(len(valBytes))
+			r.Form.Add(part.FormName(), string(valBytes))
+			values[part.FormName()] = append(values[part.FormName()], string(valBytes))
+			continue
+		}
+
+		fName, err := pzsvc.SafeName(part.FileName())
+		if err != nil || strings.HasPrefix(fName, ".") {
+			return nil, fmt.Errorf(`Invalid upload filename "%s".`, part.FileName())
+		}
+		out, err := os.OpenFile(filepath.Join(runID, fName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			return nil, fmt.Errorf(`Upload "%s" received more than once.`, fName)
+		}
+		if err != nil {
+			return nil, err
+		}
+		sum, err := pzsvc.CopySum(out, io.LimitReader(part, remaining+1))
+		if cErr := out.Close(); err == nil {
+			err = cErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		if sum.Size > remaining {
+			return nil, fmt.Errorf(`Uploads exceed the limit of %d bytes.`, maxBytes)
+		}
+		remaining -= sum.Size
+		sums[fName] = sum
+	}
+
+	// with the body consumed, this keeps later FormValue calls from
+	// trying to parse it again.
+	r.MultipartForm = &multipart.Form{Value: values}
+	return sums, nil
+}
+
+// extractInputs unpacks those inputs listed in extList (by dataId, URL or
+// upload filename) into the run folder.  Each extracted file is recorded in
+// the output's InFiles, keyed as "<source>!/<path in archive>".
+func extractInputs(extList []string, runID string, maxBytes int64, output *outStruct) error {
+	for _, entry := range extList {
+		source, _ := splitTarget(entry)
+		fName, ok := output.InFiles[source]
+		if !ok {
+			return fmt.Errorf(`Cannot extract %s.  It is not among the inputs received.`, source)
+		}
+		members, err := pzsvc.Extract(filepath.Join(runID, fName), runID, maxBytes)
+		if err != nil {
+			return fmt.Errorf(`Cannot extract %s: %s`, source, err.Error())
+		}
+		for _, member := range members {
+			output.InFiles[source+"!/"+member] = member
+		}
+	}
+	return nil
+}
+
+// inMetaFile is the name of the run-level input metadata file written when
+// InputMeta is set to "manifest".
+const inMetaFile = "inputs.pzmeta.json"
+
+// writeInputMeta writes the Piazza metadata of the run's inputs into the run
+// folder, for the served program to read.  In "sidecar" mode, each input
+// gets a "<filename>.pzmeta.json" alongside it.  In "manifest" mode, a
+// single inMetaFile maps each input's local filename to its metadata.
+func writeInputMeta(mode, runID string, metas map[string]*pzsvc.DataResource, inFiles map[string]string) error {
+	if len(metas) == 0 {
+		return nil
+	}
+	if mode == "manifest" {
+		manifest := make(map[string]*pzsvc.DataResource)
+		for source, meta := range metas {
+			manifest[inFiles[source]] = meta
+		}
+		return writeJSONFile(filepath.Join(runID, inMetaFile), manifest)
+	}
+	for source, meta := range metas {
+		err := writeJSONFile(filepath.Join(runID, inFiles[source]+".pzmeta.json"), meta)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeJSONFile writes the given object as JSON to a new file, refusing to
+// overwrite anything already there.
+func writeJSONFile(fPath string, obj interface{}) error {
+	objBytes, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(fPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		return fmt.Errorf(`Cannot write %s.  A file of that name already exists.`, filepath.Base(fPath))
+	}
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(objBytes)
+	if cErr := out.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitTarget(t *testing.T) {
+	tests := []struct {
+		entry  string
+		source string
+		target string
+	}{
+		{"abc", "abc", ""},
+		{"abc:scene.tif", "abc", "scene.tif"},
+		{"abc:", "abc:", ""},
+		{":scene.tif", ":scene.tif", ""},
+		{"abc:sub/scene.tif", "abc:sub/scene.tif", ""},
+		{`abc:sub\scene.tif`, `abc:sub\scene.tif`, ""},
+		{"https://h/a.tif", "https://h/a.tif", ""},
+		{"https://h/a.tif:b.tif", "https://h/a.tif", "b.tif"},
+		{"https://h:8443/a.tif", "https://h:8443/a.tif", ""},
+		{"https://h:8443/a.tif:b.tif", "https://h:8443/a.tif", "b.tif"},
+		{"https://h:8443", "https://h:8443", ""},
+		{"https://h/get?t=12:30", "https://h/get?t=12:30", ""},
+		{"https://h/get?t=1:b.tif", "https://h/get?t=1:b.tif", ""},
+		{"https://h/a.tif#p:1", "https://h/a.tif#p:1", ""},
+		{"file:///data/a.tif:b.tif", "file:///data/a.tif", "b.tif"},
+		{"s3://bucket/key.tif:b.tif", "s3://bucket/key.tif", "b.tif"},
+	}
+	for _, test := range tests {
+		source, target := splitTarget(test.entry)
+		if source != test.source || target != test.target {
+			t.Errorf(`splitTarget(%q) = %q, %q.  Expected %q, %q.`, test.entry, source, target, test.source, test.target)
+		}
+	}
+}
+
+func TestParseInFiles(t *testing.T) {
+	tests := []struct {
+		entries []string
+		sources []string
+		targets map[string]string
+		wantErr bool
+	}{
+		{nil, []string{}, map[string]string{}, false},
+		{[]string{"a", "b:x.tif"}, []string{"a", "b"}, map[string]string{"b": "x.tif"}, false},
+		{[]string{"https://h/get?t=12:30"}, []string{"https://h/get?t=12:30"}, map[string]string{}, false},
+		{[]string{"a", "a:x.tif"}, nil, nil, true},
+		{[]string{"a:x.tif", "b:x.tif"}, nil, nil, true},
+		{[]string{"a:.hidden"}, nil, nil, true},
+		{[]string{"a:.."}, nil, nil, true},
+	}
+	for _, test := range tests {
+		sources, targets, err := parseInFiles(test.entries)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf(`parseInFiles(%q) succeeded.  Expected an error.`, test.entries)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf(`parseInFiles(%q) failed: %s`, test.entries, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(sources, test.sources) || !reflect.DeepEqual(targets, test.targets) {
+			t.Errorf(`parseInFiles(%q) = %q, %q.  Expected %q, %q.`, test.entries, sources, targets, test.sources, test.targets)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// interfaceKey is the service metadata key under which the interface
+// description is registered with Piazza.
+const interfaceKey = "pzsvcInterface"
+
+// svcInterface is a machine-readable description of how to call this
+// service: the request parameters it takes, where inputs may come from,
+// and what outputs it can produce.  It is derived from the config, and is
+// served at /interface and registered with Piazza.
+type svcInterface struct {
+	Name			string			`json:"name,omitempty"`
+	Version			string			`json:"version,omitempty"`
+	Path			string			`json:"path"`
+	Methods			[]string		`json:"methods"`
+	ContentTypes	[]string		`json:"contentTypes"`
+	Command			string			`json:"command,omitempty"`
+	Parameters		[]ifaceParam	`json:"parameters"`
+	Inputs			ifaceInputs		`json:"inputs"`
+	Outputs			ifaceOutputs	`json:"outputs"`
+}
+
+// ifaceParam describes a single request parameter.  Type is one of
+// "string", "list" (comma separated) or "json".  DataType is the Piazza data
+// type of the files named by the parameter, where it names files to upload.
+type ifaceParam struct {
+	Name			string			`json:"name"`
+	Type			string			`json:"type"`
+	DataType		string			`json:"dataType,omitempty"`
+	Description		string			`json:"description"`
+}
+
+type ifaceInputs struct {
+	Sources			[]string		`json:"sources"`
+	DataTypes		[]string		`json:"dataTypes,omitempty"`
+	Templates		bool			`json:"templates"`
+	MaxUploadMB		int				`json:"maxUploadMB"`
+	MaxExtractMB	int				`json:"maxExtractMB"`
+}
+
+type ifaceOutputs struct {
+	DataTypes		[]string		`json:"dataTypes,omitempty"`
+	Ingest			[]string		`json:"ingest"`
+	MaxInlineKB		int				`json:"maxInlineKB"`
+}
+
+// buildInterface describes the service as configured.  Parameters that
+// require Piazza access are only listed when it is available.
+func buildInterface(configObj configType, path, version string, canFile bool) svcInterface {
+	iface := svcInterface{	Name: configObj.SvcName,
+							Version: version,
+							Path: path + "/execute",
+							Methods: []string{"POST"},
+							ContentTypes: []string{"application/x-www-form-urlencoded", "multipart/form-data"},
+							Command: configObj.CliCmd }
+
+	addParam := func(name, pType, dataType, desc string) {
+		iface.Parameters = append(iface.Parameters, ifaceParam{name, pType, dataType, desc})
+	}
+	addParam("cmd", "string", "", "Arguments appended to the command.")
+	addParam("inFiles", "list", "", "Inputs to retrieve before execution, as dataIds or URLs, each optionally followed by a colon and a local filename.")
+	addParam("inExtract", "list", "", "Inputs, as given in inFiles, that are zip, tar or tar.gz archives to extract.")
+	if canFile {
+		addParam("outTiffs", "list", "raster", "Output files to upload as rasters.")
+		addParam("outTxts", "list", "text", "Output files to upload as text.")
+		addParam("outGeoJson", "list", "geojson", "Output files to upload as GeoJSON.")
+		addParam("outMeta", "json", "", "Name, description and metadata for uploaded files, keyed by filename.")
+		addParam("authKey", "string", "", "Piazza auth key to use in place of the service's own.")
+	}
+	addParam("outInline", "list", "", "Output files to return directly in the reply.")
+	if !canFile && configObj.RetainMins > 0 {
+		addParam("outArchive", "list", "", "Output files or glob patterns to bundle into a single zip archive, retrieved through /job/{runId}/files.")
+		addParam("outArchiveName", "string", "", "Filename of the archive built through outArchive.")
+	}
+
+	sources := []string{"upload"}
+	for scheme := range getFetchers(configObj, "", canFile, nil) {
+		if scheme == "" {
+			scheme = "dataId"
+		}
+		sources = append(sources, scheme)
+	}
+	sort.Strings(sources)
+	iface.Inputs = ifaceInputs{	Sources: sources,
+								DataTypes: configObj.InputTypes,
+								Templates: configObj.CmdTemplates,
+								MaxUploadMB: configObj.UploadMaxMB,
+								MaxExtractMB: configObj.ExtractMaxMB }
+
+	iface.Outputs = ifaceOutputs{	DataTypes: configObj.OutputTypes,
+									Ingest: []string{},
+									MaxInlineKB: configObj.InlineMaxKB }
+	if canFile {
+		iface.Outputs.Ingest = []string{"raster", "text", "geojson"}
+	}
+
+	return iface
+}
+
+// interfaceAttributes returns the registration attributes from the config,
+// with the interface description added.
+func interfaceAttributes(configObj configType, iface svcInterface) map[string]string {
+	attributes := make(map[string]string)
+	for key, val := range configObj.Attributes {
+		attributes[key] = val
+	}
+	ifaceBytes, err := json.Marshal(iface)
+	if err == nil {
+		attributes[interfaceKey] = string(ifaceBytes)
+	}
+	return attributes
+}
@@ -0,0 +1,223 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runIDPattern matches the folder names generated by psuUUID
+var runIDPattern = regexp.MustCompile(`^[0-9A-F]{8}-[0-9A-F]{4}-[0-9A-F]{4}-[0-9A-F]{4}-[0-9A-F]{12}$`)
+
+// runStore keeps track of run folders that have been retained after their
+// runs finished, so that their outputs can be retrieved directly.  A
+// background reaper deletes each folder once its time is up.
+type runStore struct {
+	ttl  time.Duration
+	mu   sync.Mutex
+	runs map[string]*runRecord
+}
+
+type runRecord struct {
+	expires time.Time
+	inputs  map[string]bool // input files, which are not offered for retrieval
+}
+
+type jobFile struct {
+	Name string
+	Size int64
+}
+
+type jobListing struct {
+	RunID   string
+	Expires string
+	Files   []jobFile
+}
+
+// newRunStore creates a runStore and starts its reaper.  Run folders left
+// behind by a previous process are given the same lifetime, measured from
+// when they were last modified, but are not offered for retrieval.
+func newRunStore(ttl time.Duration) *runStore {
+	rs := &runStore{ttl: ttl, runs: make(map[string]*runRecord)}
+
+	dirs, err := ioutil.ReadDir(".")
+	if err != nil {
+		fmt.Println("error: could not check for old run folders: " + err.Error())
+	}
+	for _, dir := range dirs {
+		if dir.IsDir() && runIDPattern.MatchString(dir.Name()) {
+			rs.runs[dir.Name()] = &runRecord{expires: dir.ModTime().Add(ttl)}
+		}
+	}
+
+	go func() {
+		for {
+			rs.reap()
+			time.Sleep(time.Minute)
+		}
+	}()
+	return rs
+}
+
+// retain keeps the given run folder around until the TTL expires.
+func (rs *runStore) retain(runID string, inputs map[string]string) {
+	inSet := make(map[string]bool)
+	for _, fName := range inputs {
+		inSet[fName] = true
+	}
+	rs.mu.Lock()
+	rs.runs[runID] = &runRecord{expires: time.Now().Add(rs.ttl), inputs: inSet}
+	rs.mu.Unlock()
+}
+
+// reap deletes all run folders past their expiry.
+func (rs *runStore) reap() {
+	now := time.Now()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for runID, rec := range rs.runs {
+		if now.After(rec.expires) {
+			os.RemoveAll("./" + runID)
+			delete(rs.runs, runID)
+		}
+	}
+}
+
+// lookup returns the record for a retained run, or nil if there isn't one
+// (or if it belongs to a previous process).
+func (rs *runStore) lookup(runID string) *runRecord {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rec := rs.runs[runID]
+	if rec == nil || rec.inputs == nil || time.Now().After(rec.expires) {
+		return nil
+	}
+	return rec
+}
+
+// handleJob serves the /job/{id}/files and /job/{id}/files/{name} endpoints.
+func handleJob(w http.ResponseWriter, r *http.Request, rs *runStore) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/job/"), "/", 3)
+	if len(parts) < 2 || parts[1] != "files" {
+		fmt.Fprintf(w, "Endpoint undefined.  Try /help?\n")
+		return
+	}
+	if rs == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Run folders are not retained by this instance.\n")
+		return
+	}
+
+	runID := parts[0]
+	rec := rs.lookup(runID)
+	if rec == nil || !runIDPattern.MatchString(runID) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No retained run with ID %s.\n", runID)
+		return
+	}
+
+	if len(parts) == 2 || parts[2] == "" {
+		listing := jobListing{RunID: runID, Expires: rec.expires.UTC().Format(time.RFC3339)}
+		listing.Files = listJobFiles(runID, rec.inputs)
+		printJSON(w, listing)
+		return
+	}
+
+	fPath, err := outPath(runID, parts[2])
+	if err != nil || !offered(filepath.Clean(parts[2]), rec.inputs) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No file %s in run %s.\n", parts[2], runID)
+		return
+	}
+	info, err := regularFile(runID, filepath.Clean(parts[2]))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No file %s in run %s.\n", parts[2], runID)
+		return
+	}
+	file, err := os.Open(fPath)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No file %s in run %s.\n", parts[2], runID)
+		return
+	}
+	defer file.Close()
+	// make sure it is still the file that was checked.
+	if openInfo, err := file.Stat(); err != nil || !os.SameFile(info, openInfo) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No file %s in run %s.\n", parts[2], runID)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filepath.Base(fPath)))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// listJobFiles lists the regular files in a run folder that are offered
+// for retrieval, as paths relative to the folder.  Symlinks are left out,
+// and not followed.
+func listJobFiles(runID string, inputs map[string]bool) []jobFile {
+	files := []jobFile{}
+	filepath.Walk(runID, func(fPath string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(runID, fPath)
+		if err != nil || !offered(rel, inputs) {
+			return nil
+		}
+		files = append(files, jobFile{filepath.ToSlash(rel), info.Size()})
+		return nil
+	})
+	return files
+}
+
+// offered reports whether the file at the given path within a run folder is
+// one of its outputs.  Inputs are not, and neither are the run manifest and
+// input metadata files written for the program.
+func offered(rel string, inputs map[string]bool) bool {
+	return !inputs[rel] && rel != runManifestFile && !strings.HasSuffix(rel, ".pzmeta.json")
+}
+
+// regularFile returns the info of the file at the given path within dir,
+// provided it is a regular file, and neither it nor any folder on the way
+// to it is a symlink.
+func regularFile(dir, rel string) (os.FileInfo, error) {
+	fPath := dir
+	var info os.FileInfo
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		fPath = filepath.Join(fPath, part)
+		var err error
+		info, err = os.Lstat(fPath)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil, fmt.Errorf(`%s is a symlink.`, fPath)
+		}
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf(`%s is not a regular file.`, fPath)
+	}
+	return info, nil
+}
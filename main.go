@@ -22,10 +22,12 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/venicegeo/pzsvc-exec/pzsvc"
@@ -42,13 +44,53 @@ type configType struct {
 	Port        int
 	Description	string
 	Attributes	map[string]string
+	AllowHosts	[]string
+	FileRoot	string
+	S3Endpoint	string
+	CacheDir	string
+	CacheMaxMB	int
+	CacheTTLMins	int
+	MaxTransfers	int
+	CmdTemplates	bool
+	InlineMaxKB	int
+	UploadMaxMB	int
+	RetainMins	int
+	ExtractMaxMB	int
+	Classification	string
+	IngestMetadata	map[string]string
+	IngestProvenance	bool
+	TagInputs	bool
+	InputMeta	string
+	RunManifest	bool
+	Deregister	string
+	RegCheckMins	int
+	PzUser		string
+	InstanceID	string
+	InputTypes	[]string
+	OutputTypes	[]string
+	Services	[]json.RawMessage
+	Watch		*watchConfig
+	MaxRuns		int
+	MinFreeMB	int
+	ShutdownWaitSecs	int
 }
 
 type outStruct struct {
+	RunID		string
 	InFiles		map[string]string
 	OutFiles	map[string]string
+	InSums		map[string]pzsvc.FileSum
+	OutSums		map[string]pzsvc.FileSum
+	InlineFiles	map[string]inlineFile
+	Provenance	*provDoc
+	ProvDataID	string
+	ArchiveManifest	[]pzsvc.ManifestEntry	`json:",omitempty"`
 	ProgReturn	string
 	Errors		[]string
+
+	// for metrics only.  Not part of the reply.
+	times		runTimes
+	exitCode	int
 }
 
 func main() {
@@ -69,80 +111,112 @@ func main() {
 	if err != nil {
 		fmt.Println("error:", err.Error())
 	}
-	canReg, canFile, hasAuth := checkConfig(&configObj)
 
-	var authKey string
-	if hasAuth {
-		authKey = os.Getenv(configObj.AuthEnVar)
-		if authKey == "" {
-			fmt.Println("Error: no auth key at AuthEnVar.  Registration disabled, and client will have to provide authKey.")
+	// set up before anything talks to Piazza, so that every call is counted.
+	limiter := newRunLimiter(configObj.MaxRuns)
+	met := newMetrics(limiter)
+	pzsvc.SetCallObserver(met.observePz)
+
+	var services []*service
+	canFile := configObj.PzAddr != ""
+	if len(configObj.Services) == 0 {
+		services = append(services, newService(configObj, ""))
+	} else {
+		// the top level only supplies defaults for the entries under
+		// Services, and is not itself served or registered.
+		subConfigs, err := serviceConfigs(configObj)
+		if err != nil {
+			fmt.Println("error:", err.Error())
+			return
+		}
+		for _, subConfig := range subConfigs {
+			fmt.Println("Config for service " + subConfig.SvcName + ":")
+			services = append(services, newService(subConfig, "/svc/" + subConfig.SvcName))
+		}
+		if configObj.Port <= 0 {
+			fmt.Println(`Config: Port not specified, or incorrect format.  Default to 8080.`)
 		}
-		hasAuth = false
-		canReg = false
 	}
 
 	if configObj.Port <= 0 {
 		configObj.Port = 8080
 	}
 	portStr := ":" + strconv.Itoa(configObj.Port)
-	
-	version := getVersion(configObj)
-
-	if canReg {
-		fmt.Println("About to manage registration.")
-		err = pzsvc.ManageRegistration(	configObj.SvcName,
-										configObj.Description,
-										configObj.URL + "/execute",
-										configObj.PzAddr,
-										version,
-										authKey,
-										configObj.Attributes )
+
+	// any one service downloading from Piazza is enough to call for the
+	// cache.
+	var cache *pzsvc.Cache
+	useCache := false
+	for _, svc := range services {
+		useCache = useCache || svc.canFile
+	}
+	if useCache && configObj.CacheDir != "" {
+		cache, err = pzsvc.NewCache(configObj.CacheDir,
+									int64(configObj.CacheMaxMB) * 1024 * 1024,
+									time.Duration(configObj.CacheTTLMins) * time.Minute)
+		if err != nil {
+			fmt.Println("error: could not create download cache: " + err.Error())
+		}
+	}
+
+	var runs *runStore
+	if configObj.RetainMins > 0 {
+		runs = newRunStore(time.Duration(configObj.RetainMins) * time.Minute)
+	}
+
+	if configObj.MinFreeMB <= 0 {
+		configObj.MinFreeMB = 100
+	}
+	hl := newHealth(services, limiter, configObj.MinFreeMB)
+
+	for _, svc := range services {
+		if svc.configObj.Watch == nil {
+			continue
+		}
+		if svc.authKey == "" {
+			fmt.Println("error: Watch requires Piazza access and an auth key at AuthEnVar.  Watch disabled for " + svc.configObj.SvcName + ".")
+			continue
+		}
+		svc.watch, err = newWatcher(svc, cache, runs, limiter, met)
 		if err != nil {
 			fmt.Println("error:", err.Error())
+			continue
 		}
-		fmt.Println("Registration managed.")
+		go svc.watch.run()
 	}
 	
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
-		switch r.URL.Path {
-		case "/":
-			{
-				fmt.Fprintf(w, "Hello.  This is pzsvc-exec")
-				if configObj.SvcName != "" {
-					fmt.Fprintf(w, ", serving %s", configObj.SvcName)
-				}
-				fmt.Fprintf(w, ".\nWere you possibly looking for the /help or /execute endpoints?")
-			}
-		case "/execute":
-			{
-				// the other options are shallow and informational.  This is the
-				// place where the work gets done.
-				output := execute (w, r, configObj, authKey, version, canFile)
-				printJSON(w, output)
-			}
-		case "/description":
-			if configObj.Description == "" {
-				fmt.Fprintf(w, "No description defined")
-			} else {
-				fmt.Fprintf(w, configObj.Description)
-			}
-		case "/attributes":
-			if configObj.Attributes == nil {
-				fmt.Fprintf(w, "{ }")
-			} else {
-				printJSON(w, configObj.Attributes)
-			}
-		case "/help":
+		if r.URL.Path == "/help" {
 			printHelp(w)
-		case "/version":
-			fmt.Fprintf(w, version)
-		default:
+		} else if r.URL.Path == "/health/live" {
+			handleLive(w)
+		} else if r.URL.Path == "/health/ready" {
+			hl.handleReady(w)
+		} else if r.URL.Path == "/metrics" {
+			met.handleMetrics(w)
+		} else if r.URL.Path == "/" && len(configObj.Services) != 0 {
+			fmt.Fprintf(w, "Hello.  This is pzsvc-exec, serving:\n")
+			for _, svc := range services {
+				fmt.Fprintf(w, "- %s, at %s/execute\n", svc.configObj.SvcName, svc.path)
+			}
+		} else if strings.HasPrefix(r.URL.Path, "/job/") {
+			handleJob(w, r, runs)
+		} else if strings.HasPrefix(r.URL.Path, "/data/") {
+			handleDataMeta(w, r, configObj, canFile)
+		} else if svc, subPath := findService(services, r.URL.Path); svc == nil || !svc.serve(w, r, subPath, cache, runs, limiter, met) {
 			fmt.Fprintf(w, "Endpoint undefined.  Try /help?\n")
 		}
 	})
 
-	log.Fatal(http.ListenAndServe(portStr, nil))
+	server := &http.Server{Addr: portStr}
+	go func() {
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	awaitShutdown(server, configObj.ShutdownWaitSecs, services)
 }
 
 // execute does the primary work for pzsvc-exec.  Given a request and various
@@ -151,11 +225,17 @@ func main() {
 // the command indicated by the combination of request and configs, uploads
 // any files indicated by the request (if the configs support it) and cleans
 // up after itself
-func execute(w http.ResponseWriter, r *http.Request, configObj configType, authKey, version string, canFile bool) outStruct {
+func execute(w http.ResponseWriter, r *http.Request, configObj configType, authKey, version string, canFile bool, cache *pzsvc.Cache, runs *runStore) outStruct {
 
 	var output outStruct
+	times := &output.times
+	times.start = time.Now()
+	output.exitCode = -1
 	output.InFiles = make(map[string]string)
 	output.OutFiles = make(map[string]string)
+	output.InSums = make(map[string]pzsvc.FileSum)
+	output.OutSums = make(map[string]pzsvc.FileSum)
+	output.InlineFiles = make(map[string]inlineFile)
 
 	if r.Method != "POST" {
 		output.Errors = append(output.Errors, "This endpoint does not support that method.  Please try again with POST.")
@@ -163,6 +243,38 @@ func execute(w http.ResponseWriter, r *http.Request, configObj configType, authK
 		return output
 	}
 
+	runID, err := psuUUID()
+	handleError(&output, err, w, http.StatusInternalServerError)
+
+	err = os.Mkdir("./"+runID, 0777)
+	handleError(&output, err, w, http.StatusInternalServerError)
+	output.RunID = runID
+	defer func() {
+		if runs != nil {
+			runs.retain(runID, output.InFiles)
+		} else {
+			os.RemoveAll("./" + runID)
+		}
+	}()
+
+	err = os.Chmod("./"+runID, 0777)
+	handleError(&output, err, w, http.StatusInternalServerError)
+
+	// uploaded files are streamed straight into the run folder, which
+	// is why the folder has to exist before we look at any parameters.
+	if len(output.Errors) == 0 && isMultipart(r) {
+		upSums, err := receiveUploads(r, runID, int64(configObj.UploadMaxMB) * 1024 * 1024)
+		if err != nil {
+			output.Errors = append(output.Errors, err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return output
+		}
+		for fName, sum := range upSums {
+			output.InFiles[fName] = fName
+			output.InSums[fName] = sum
+		}
+	}
+
 	cmdParam := r.FormValue("cmd")
 	cmdParamSlice := splitOrNil(cmdParam, " ")
 	cmdConfigSlice := splitOrNil(configObj.CliCmd, " ")
@@ -172,41 +284,98 @@ func execute(w http.ResponseWriter, r *http.Request, configObj configType, authK
 	outTiffSlice := splitOrNil(r.FormValue("outTiffs"), ",")
 	outTxtSlice := splitOrNil(r.FormValue("outTxts"), ",")
 	outGeoJSlice := splitOrNil(r.FormValue("outGeoJson"), ",")
+	outInlineSlice := splitOrNil(r.FormValue("outInline"), ",")
+	inExtractSlice := splitOrNil(r.FormValue("inExtract"), ",")
+	outArchSlice := splitOrNil(r.FormValue("outArchive"), ",")
+	outArchName := r.FormValue("outArchiveName")
+	if outArchName == "" && len(outArchSlice) != 0 {
+		outArchName = "outputs.zip"
+	}
+
+	outMeta, err := parseOutMeta(r.FormValue("outMeta"))
+	if err != nil {
+		output.Errors = append(output.Errors, err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return output
+	}
 	
 	if 	r.FormValue("authKey") != "" {
 		authKey = r.FormValue("authKey")
 	}
 
-	if !canFile && (len(inFileSlice) + len(outTiffSlice) + len(outTxtSlice) + len(outGeoJSlice) != 0) {
+	inSources, inTargets, err := parseInFiles(inFileSlice)
+	if err != nil {
+		output.Errors = append(output.Errors, err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return output
+	}
+
+	// Only Piazza dataIds need Piazza access.  Direct URL inputs are
+	// governed by their own config entries.
+	pzInCount := 0
+	for _, source := range inSources {
+		if pzsvc.SourceScheme(source) == "" {
+			pzInCount++
+		}
+	}
+
+	// Pz has no data type for archives, so they are only ever offered from
+	// the run folder, and only where nothing goes to Pz.
+	if len(outArchSlice) != 0 && (canFile || runs == nil) {
+		output.Errors = append(output.Errors, "Cannot complete.  outArchive requires RetainMins, and is not available where outputs are uploaded to Piazza.")
+		w.WriteHeader(http.StatusBadRequest)
+		return output
+	}
+
+	if !canFile && (pzInCount + len(outTiffSlice) + len(outTxtSlice) + len(outGeoJSlice) != 0) {
 		output.Errors = append(output.Errors, "Cannot complete.  File up/download not enabled in config file.")
 		w.WriteHeader(http.StatusForbidden)
 		return output
 	}
 
-	if authKey == "" && (len(inFileSlice) + len(outTiffSlice) + len(outTxtSlice) + len(outGeoJSlice) != 0) {
+	if authKey == "" && (pzInCount + len(outTiffSlice) + len(outTxtSlice) + len(outGeoJSlice) != 0) {
 		output.Errors = append(output.Errors, "Cannot complete.  Auth Key not available.")
 		w.WriteHeader(http.StatusForbidden)
 		return output
 	}
 
-	runID, err := psuUUID()
-	handleError(&output, err, w, http.StatusInternalServerError)
-
-	err = os.Mkdir("./"+runID, 0777)
-	handleError(&output, err, w, http.StatusInternalServerError)
-	defer os.RemoveAll("./" + runID)
-
-	err = os.Chmod("./"+runID, 0777)
-	handleError(&output, err, w, http.StatusInternalServerError)
-
 	// this is done to enable use of handleFList, which lets us
 	// reduce a fair bit of code duplication in plowing through
 	// our upload/download lists.  handleFList gets used a fair
 	// bit more after the execute call.
-	downlFunc := func(dataID, fType string) (string, error) {
-		return pzsvc.Download(dataID, runID, configObj.PzAddr, authKey)
+	fetchers := getFetchers(configObj, authKey, canFile, cache)
+	var metaLock sync.Mutex
+	inMetas := make(map[string]*pzsvc.DataResource)
+	downlFunc := func(source, fType string) (string, pzsvc.FileSum, error) {
+		fName, sum, meta, err := fetchInput(fetchers, source, inTargets[source], runID)
+		if err != nil || configObj.InputMeta == "" || pzsvc.SourceScheme(source) != "" {
+			return fName, sum, err
+		}
+		if meta == nil {
+			meta, err = pzsvc.GetFileMeta(source, configObj.PzAddr, authKey)
+			if err != nil {
+				return fName, sum, err
+			}
+		}
+		metaLock.Lock()
+		inMetas[source] = meta
+		metaLock.Unlock()
+		return fName, sum, nil
+	}
+	handleFList(makeTasks(inSources, ""), downlFunc, configObj.MaxTransfers, &output, output.InFiles, output.InSums, w)
+	times.downloaded = time.Now()
+
+	err = writeInputMeta(configObj.InputMeta, runID, inMetas, output.InFiles)
+	handleError(&output, err, w, http.StatusInternalServerError)
+
+	if len(output.Errors) == 0 {
+		err = extractInputs(inExtractSlice, runID, int64(configObj.ExtractMaxMB) * 1024 * 1024, &output)
+		handleError(&output, err, w, http.StatusBadRequest)
+	}
+
+	if configObj.CmdTemplates {
+		cmdSlice = fillTemplates(cmdSlice, inSources, output.InFiles)
 	}
-	handleFList(inFileSlice, downlFunc, "", &output, output.InFiles, w)
 
 	if len(cmdSlice) == 0 {
 		output.Errors = append(output.Errors, `No cmd or CliCmd.  Please provide "cmd" param.`)
@@ -229,49 +398,210 @@ func execute(w http.ResponseWriter, r *http.Request, configObj configType, authK
 	clc := exec.Command(cmdSlice[0], cmdSlice[1:]...)
 	clc.Dir = runID
 
+	if configObj.RunManifest {
+		manifest := runManifest{RunID: runID, Service: configObj.SvcName, Version: version, Argv: cmdSlice,
+			Outputs: manifestOutputs{outTiffSlice, outTxtSlice, outGeoJSlice, outInlineSlice, outArchSlice, outArchName}}
+		manPath, err := writeRunManifest(manifest, configObj, r.Form, inSources, &output)
+		handleError(&output, err, w, http.StatusInternalServerError)
+		clc.Env = append(os.Environ(), runManifestEnv + "=" + manPath)
+	}
+
 	var b bytes.Buffer
 	clc.Stdout = &b
 	clc.Stderr = os.Stderr
 
 	err = clc.Run()
 	handleError(&output, err, w, http.StatusBadRequest)
+	times.executed = time.Now()
+	if clc.ProcessState != nil {
+		output.exitCode = clc.ProcessState.ExitCode()
+	}
 	
 	output.ProgReturn = b.String()
 				
 	fmt.Printf("Program output: %s\n", output.ProgReturn)
 
+	// inline outputs go back in the response rather than to Piazza, and so
+	// are handled whether or not file upload is enabled.
+	for _, fName := range outInlineSlice {
+		inline, sum, err := readInline(runID, fName, int64(configObj.InlineMaxKB) * 1024)
+		if err != nil {
+			handleError(&output, err, w, http.StatusBadRequest)
+			continue
+		}
+		output.InlineFiles[fName] = inline
+		output.OutSums[fName] = sum
+	}
+
 	attMap := make(map[string]string)
 	attMap["algoName"] = configObj.SvcName
 	attMap["algoVersion"] = version
 	attMap["algoCmd"] = configObj.CliCmd + " " + cmdParam
 	attMap["algoProcTime"] = time.Now().UTC().Format("20060102.150405.99999")
+
+	// record the Piazza inputs of the run on each output, for provenance.
+	var inDataIDs []string
+	for _, source := range inSources {
+		if _, ok := output.InFiles[source]; ok && pzsvc.SourceScheme(source) == "" {
+			inDataIDs = append(inDataIDs, source)
+		}
+	}
+	if len(inDataIDs) != 0 {
+		attMap["inputDataIds"] = strings.Join(inDataIDs, ",")
+	}
 	
 	// this is the other spot that handleFlist gets used, and works on the
 	// same principles.
 
-	ingFunc := func(fName, fType string) (string, error) {
-		return pzsvc.IngestFile(fName, runID, fType, configObj.PzAddr, configObj.SvcName, version, authKey, attMap)
+	ingFunc := func(fName, fType string) (string, pzsvc.FileSum, error) {
+		sum, err := pzsvc.SumFile("./" + runID + "/" + fName)
+		if err != nil {
+			return "", sum, err
+		}
+		rMeta := buildResMeta(fName, fType, runID, version, configObj, outMeta[fName], attMap)
+		dataID, err := pzsvc.IngestFileMeta(fName, runID, fType, configObj.PzAddr, authKey, rMeta)
+		return dataID, sum, err
+	}
+
+	outTasks := makeTasks(outTiffSlice, "raster")
+	outTasks = append(outTasks, makeTasks(outTxtSlice, "text")...)
+	outTasks = append(outTasks, makeTasks(outGeoJSlice, "geojson")...)
+
+	if len(outArchSlice) != 0 {
+		output.ArchiveManifest, err = buildArchive(runID, outArchName, outArchSlice)
+		handleError(&output, err, w, http.StatusBadRequest)
+	}
+
+	handleFList(outTasks, ingFunc, configObj.MaxTransfers, &output, output.OutFiles, output.OutSums, w)
+	times.finished = time.Now()
+
+	output.Provenance = buildProv(runID, version, configObj, cmdSlice, inSources, &output, *times)
+	if configObj.IngestProvenance && canFile && authKey != "" {
+		output.ProvDataID, err = ingestProv(output.Provenance, runID, version, configObj, authKey, &output)
+		handleError(&output, err, w, http.StatusInternalServerError)
 	}
 
-	handleFList(outTiffSlice, ingFunc, "raster", &output, output.OutFiles, w)
-	handleFList(outTxtSlice, ingFunc, "text", &output, output.OutFiles, w)
-	handleFList(outGeoJSlice, ingFunc, "geojson", &output, output.OutFiles, w)
+	// only successful runs count as having processed their inputs.
+	if configObj.TagInputs && canFile && authKey != "" && len(output.Errors) == 0 {
+		tagMap := map[string]string{
+			"lastProcessedBy": configObj.SvcName,
+			"processedBy:" + configObj.SvcName: times.finished.UTC().Format(time.RFC3339)}
+		for _, dataID := range inDataIDs {
+			err = pzsvc.UpdateFileMeta(dataID, configObj.PzAddr, authKey, tagMap)
+			handleError(&output, err, w, http.StatusInternalServerError)
+		}
+	}
 	
 	return output
 }
 
-type rangeFunc func(string, string) (string, error)
+type rangeFunc func(string, string) (string, pzsvc.FileSum, error)
 
-func handleFList(fList []string, lFunc rangeFunc, fType string, output *outStruct, fileRec map[string]string, w http.ResponseWriter) {
-	for _, f := range fList {
-		outStr, err := lFunc(f, fType)
-		if err != nil {
-			output.Errors = append(output.Errors, err.Error())
-			w.WriteHeader(http.StatusBadRequest)
+// fileTask is a single file to be handled by handleFList, along with
+// its file type.
+type fileTask struct {
+	fName	string
+	fType	string
+}
+
+func makeTasks(fList []string, fType string) []fileTask {
+	tasks := make([]fileTask, len(fList))
+	for i, f := range fList {
+		tasks[i] = fileTask{f, fType}
+	}
+	return tasks
+}
+
+// handleFList runs lFunc on each of the given tasks, with up to limit of
+// them running at once.  Results, checksums and errors are recorded in task
+// order regardless of the order in which they complete, so that output is
+// deterministic.
+func handleFList(tasks []fileTask, lFunc rangeFunc, limit int, output *outStruct, fileRec map[string]string, sumRec map[string]pzsvc.FileSum, w http.ResponseWriter) {
+	if limit <= 0 {
+		limit = 1
+	}
+	results := make([]string, len(tasks))
+	sums := make([]pzsvc.FileSum, len(tasks))
+	errs := make([]error, len(tasks))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, limit)
+	for i, task := range tasks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, task fileTask) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i], sums[i], errs[i] = lFunc(task.fName, task.fType)
+		}(i, task)
+	}
+	wg.Wait()
+
+	failed := false
+	for i, task := range tasks {
+		if errs[i] != nil {
+			output.Errors = append(output.Errors, errs[i].Error())
+			failed = true
 		} else {
-			fileRec[f] = outStr
+			fileRec[task.fName] = results[i]
+			sumRec[task.fName] = sums[i]
 		}
 	}
+	if failed {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// getFetchers builds the set of input fetchers enabled by the config.
+func getFetchers(configObj configType, authKey string, canFile bool, cache *pzsvc.Cache) pzsvc.FetcherSet {
+	fetchers := make(pzsvc.FetcherSet)
+	if canFile {
+		fetchers[""] = pzsvc.PzFetcher{PzAddr: configObj.PzAddr, AuthKey: authKey, Cache: cache}
+	}
+	if len(configObj.AllowHosts) != 0 {
+		httpFetcher := pzsvc.HTTPFetcher{AllowHosts: configObj.AllowHosts}
+		fetchers["http"] = httpFetcher
+		fetchers["https"] = httpFetcher
+	}
+	if configObj.FileRoot != "" {
+		fetchers["file"] = pzsvc.FileFetcher{Root: configObj.FileRoot}
+	}
+	if configObj.S3Endpoint != "" {
+		fetchers["s3"] = pzsvc.S3Fetcher{Endpoint: configObj.S3Endpoint}
+	}
+	return fetchers
+}
+
+// handleDataMeta serves the /data/{dataId} endpoint, which passes along the
+// Piazza metadata for the given dataId so that clients can inspect their
+// inputs before submitting them.  Callers must supply their own authKey.
+// The service's key would let anyone read whatever it can.
+func handleDataMeta(w http.ResponseWriter, r *http.Request, configObj configType, canFile bool) {
+	dataID := strings.TrimPrefix(r.URL.Path, "/data/")
+	authKey := r.FormValue("authKey")
+	if !canFile {
+		w.WriteHeader(http.StatusForbidden)
+		printJSON(w, outStruct{Errors: []string{"Cannot complete.  Piazza access not enabled in config file."}})
+		return
+	}
+	if authKey == "" {
+		w.WriteHeader(http.StatusForbidden)
+		printJSON(w, outStruct{Errors: []string{"Cannot complete.  Please provide an authKey."}})
+		return
+	}
+	if dataID == "" || strings.Contains(dataID, "/") {
+		w.WriteHeader(http.StatusBadRequest)
+		printJSON(w, outStruct{Errors: []string{"Please provide a single dataId: /data/{dataId}."}})
+		return
+	}
+
+	dataRes, err := pzsvc.GetFileMeta(url.PathEscape(dataID), configObj.PzAddr, authKey)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		printJSON(w, outStruct{Errors: []string{err.Error()}})
+		return
+	}
+	printJSON(w, dataRes)
 }
 
 func handleError(output *outStruct, err error, w http.ResponseWriter, httpStat int) {
@@ -385,9 +715,67 @@ func checkConfig (configObj *configType) (bool, bool, bool) {
 		}
 	}
 
+	if configObj.CacheDir == "" {
+		if configObj.CacheMaxMB != 0 || configObj.CacheTTLMins != 0 {
+			fmt.Println(`Config: CacheMaxMB/CacheTTLMins were specified, but are meaningless without CacheDir.`)
+		}
+	} else if !canFile {
+		fmt.Println(`Config: CacheDir was specified, but is meaningless without file download.`)
+	}
+
+	if configObj.InputMeta != "" && configObj.InputMeta != "sidecar" && configObj.InputMeta != "manifest" {
+		fmt.Println(`Config: InputMeta must be "sidecar" or "manifest".  Default to "sidecar".`)
+		configObj.InputMeta = "sidecar"
+	}
+
+	if configObj.Deregister != "" && configObj.Deregister != "offline" && configObj.Deregister != "delete" && configObj.Deregister != "none" {
+		fmt.Println(`Config: Deregister must be "offline", "delete", or "none".  Default to "offline".`)
+		configObj.Deregister = "offline"
+	}
+	if !canReg && configObj.Deregister != "" {
+		fmt.Println(`Config: Deregister was specified, but is meaningless without autoregistration.`)
+	}
+	if !canReg && configObj.RegCheckMins != 0 {
+		fmt.Println(`Config: RegCheckMins was specified, but is meaningless without autoregistration.`)
+	} else if canReg && configObj.RegCheckMins <= 0 {
+		fmt.Println(`Config: RegCheckMins not specified, or incorrect format.  Default to 10.`)
+	}
+	if !canReg && (configObj.PzUser != "" || configObj.InstanceID != "") {
+		fmt.Println(`Config: PzUser/InstanceID were specified, but are meaningless without autoregistration.`)
+	} else if canReg && configObj.PzUser == "" {
+		fmt.Println(`Config: PzUser not specified.  Services registered by other users may be mistaken for this one.`)
+	}
+
+	if configObj.Watch != nil && configObj.Watch.IntervalSecs <= 0 {
+		fmt.Println(`Config: Watch.IntervalSecs not specified, or incorrect format.  Default to 60.`)
+	}
+	if configObj.Watch != nil && configObj.Watch.MaxAttempts <= 0 {
+		fmt.Println(`Config: Watch.MaxAttempts not specified, or incorrect format.  Default to 3.`)
+	}
+
 	if configObj.Port <= 0 {
 		fmt.Println(`Config: Port not specified, or incorrect format.  Default to 8080.`)
 	}
+
+	if configObj.MaxTransfers <= 0 {
+		fmt.Println(`Config: MaxTransfers not specified, or incorrect format.  Default to 4.`)
+	}
+
+	if configObj.InlineMaxKB <= 0 {
+		fmt.Println(`Config: InlineMaxKB not specified, or incorrect format.  Default to 64.`)
+	}
+
+	if configObj.UploadMaxMB <= 0 {
+		fmt.Println(`Config: UploadMaxMB not specified, or incorrect format.  Default to 100.`)
+	}
+
+	if configObj.ExtractMaxMB <= 0 {
+		fmt.Println(`Config: ExtractMaxMB not specified, or incorrect format.  Default to 1024.`)
+	}
+
+	if configObj.MinFreeMB <= 0 {
+		fmt.Println(`Config: MinFreeMB not specified, or incorrect format.  Default to 100.`)
+	}
 	
 	return canReg, canFile, hasAuth
 }
@@ -401,5 +789,17 @@ func printHelp(w http.ResponseWriter) {
 	fmt.Fprintln(w, `- '/description': When enabled, provides a description of this particular pzsvc-exec instance.`)
 	fmt.Fprintln(w, `- '/attributes': When enabled, provides a list of key/value attributes for this pzsvc-exec instance.`)
 	fmt.Fprintln(w, `- '/version': When enabled, provides version number for the application served by this pzsvc-exec instance.`)
+	fmt.Fprintln(w, `- '/interface': Describes the parameters, inputs and outputs of this pzsvc-exec instance, in JSON.`)
+	fmt.Fprintln(w, `- '/registration': When enabled, reports the outcome of the latest Piazza registration checks.`)
+	fmt.Fprintln(w, `- '/watch': When enabled, reports on the automatic processing of new Piazza data.`)
+	fmt.Fprintln(w, `- '/job/{runID}/files': When enabled, lists the output files of a completed run.`)
+	fmt.Fprintln(w, `- '/job/{runID}/files/{name}': When enabled, downloads an output file of a completed run.`)
+	fmt.Fprintln(w, `- '/data/{dataId}': When enabled, provides the Piazza metadata for the given dataId.  Requires an authKey.`)
+	fmt.Fprintln(w, `- '/svc/{name}/...': When the config declares Services, each is served under its own name, with the`)
+	fmt.Fprintln(w, `  '/execute', '/description', '/attributes', '/version', '/interface', '/registration' and '/watch' endpoints as above.`)
+	fmt.Fprintln(w, `- '/health/live': Reports that the service is up.`)
+	fmt.Fprintln(w, `- '/health/ready': Checks the command, VersionCmd, Piazza access, disk space and run queue, in JSON.`)
+	fmt.Fprintln(w, `  Replies 503 if any check fails.`)
+	fmt.Fprintln(w, `- '/metrics': Run, transfer and Piazza call statistics, in the Prometheus text format.`)
 	fmt.Fprintln(w, `- '/help': This screen.`)
 }
\ No newline at end of file
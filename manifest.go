@@ -0,0 +1,143 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// runManifestFile is the name of the manifest written into each run folder
+// when RunManifest is enabled, and runManifestEnv the environment variable
+// through which the served program learns its path.
+const (
+	runManifestFile = "run.json"
+	runManifestEnv  = "PZSVC_RUN_MANIFEST"
+)
+
+// runManifest describes a run to the program being served, so that it can
+// find its inputs, learn what outputs are expected of it and read its
+// parameters without relying on argv conventions.
+type runManifest struct {
+	RunID		string			`json:"runId"`
+	Service		string			`json:"service"`
+	Version		string			`json:"version"`
+	WorkDir		string			`json:"workDir"`
+	Argv		[]string		`json:"argv"`
+	Params		map[string][]string	`json:"params"`
+	Inputs		[]manifestInput		`json:"inputs"`
+	InputMeta	string			`json:"inputMeta,omitempty"`
+	Outputs		manifestOutputs		`json:"outputs"`
+	Limits		manifestLimits		`json:"limits"`
+}
+
+// manifestInput is a single input file.  Path is relative to WorkDir.
+// Source is the dataId, URL or upload filename it came from, and for files
+// extracted from archives, ExtractedFrom is the source of the archive.
+type manifestInput struct {
+	Source		string	`json:"source"`
+	Path		string	`json:"path"`
+	Size		int64	`json:"size,omitempty"`
+	SHA256		string	`json:"sha256,omitempty"`
+	ExtractedFrom	string	`json:"extractedFrom,omitempty"`
+}
+
+// manifestOutputs lists the files the caller expects the program to
+// produce, by how they will be handled.
+type manifestOutputs struct {
+	Tiffs		[]string	`json:"tiffs"`
+	Texts		[]string	`json:"texts"`
+	GeoJSON		[]string	`json:"geojson"`
+	Inline		[]string	`json:"inline"`
+	Archive		[]string	`json:"archive"`
+	ArchiveName	string		`json:"archiveName,omitempty"`
+}
+
+type manifestLimits struct {
+	InlineMaxBytes	int64	`json:"inlineMaxBytes"`
+	UploadMaxBytes	int64	`json:"uploadMaxBytes"`
+	ExtractMaxBytes	int64	`json:"extractMaxBytes"`
+	MaxTransfers	int	`json:"maxTransfers"`
+}
+
+// writeRunManifest fills in the parts of the manifest that come from the
+// run's results so far and writes it into the run folder, returning its
+// absolute path.
+func writeRunManifest(manifest runManifest, configObj configType, form url.Values, inSources []string, output *outStruct) (string, error) {
+	workDir, err := filepath.Abs(manifest.RunID)
+	if err != nil {
+		return "", err
+	}
+	manifest.WorkDir = workDir
+
+	// the auth key is nobody's business but ours.
+	manifest.Params = make(map[string][]string)
+	for key, vals := range form {
+		if key != "authKey" {
+			manifest.Params[key] = vals
+		}
+	}
+
+	// inputs are listed in request order, followed by uploads, followed
+	// by anything extracted from archives.
+	manifest.Inputs = []manifestInput{}
+	listed := make(map[string]bool)
+	addInput := func(source string) {
+		if fName, ok := output.InFiles[source]; ok && !listed[source] {
+			listed[source] = true
+			sum := output.InSums[source]
+			manifest.Inputs = append(manifest.Inputs, manifestInput{Source: source, Path: fName, Size: sum.Size, SHA256: sum.SHA256})
+		}
+	}
+	for _, source := range inSources {
+		addInput(source)
+	}
+	var extracted []string
+	for _, source := range sortedKeys(output.InFiles) {
+		if strings.Contains(source, "!/") {
+			extracted = append(extracted, source)
+		} else {
+			addInput(source)
+		}
+	}
+	for _, source := range extracted {
+		i := strings.Index(source, "!/")
+		manifest.Inputs = append(manifest.Inputs, manifestInput{Source: source, Path: output.InFiles[source], ExtractedFrom: source[:i]})
+	}
+
+	// the program should be able to count on lists, even empty ones.
+	for _, list := range []*[]string{&manifest.Outputs.Tiffs, &manifest.Outputs.Texts, &manifest.Outputs.GeoJSON, &manifest.Outputs.Inline, &manifest.Outputs.Archive} {
+		if *list == nil {
+			*list = []string{}
+		}
+	}
+
+	switch configObj.InputMeta {
+	case "manifest":
+		manifest.InputMeta = inMetaFile
+	case "sidecar":
+		manifest.InputMeta = "sidecar"
+	}
+
+	manifest.Limits = manifestLimits{
+		InlineMaxBytes:		int64(configObj.InlineMaxKB) * 1024,
+		UploadMaxBytes:		int64(configObj.UploadMaxMB) * 1024 * 1024,
+		ExtractMaxBytes:	int64(configObj.ExtractMaxMB) * 1024 * 1024,
+		MaxTransfers:		configObj.MaxTransfers}
+
+	fPath := filepath.Join(workDir, runManifestFile)
+	return fPath, writeJSONFile(fPath, manifest)
+}
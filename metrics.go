@@ -0,0 +1,208 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pzsvc-exec/pzsvc"
+)
+
+var stageBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800}
+var pzBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metrics collects the figures served at /metrics, in the Prometheus text
+// exposition format.
+type metrics struct {
+	limiter		*runLimiter
+
+	mu			sync.Mutex
+	runs		*metricVec
+	stages		*metricVec
+	bytes		*metricVec
+	pzCalls		*metricVec
+	pzLatency	*metricVec
+}
+
+func newMetrics(limiter *runLimiter) *metrics {
+	return &metrics{
+		limiter:	limiter,
+		runs:		newMetricVec("pzsvc_exec_runs_total", "Runs carried out, by outcome and program exit code.", nil, "service", "outcome", "exit_code"),
+		stages:		newMetricVec("pzsvc_exec_stage_duration_seconds", "Time spent in each stage of a run.", stageBuckets, "service", "stage"),
+		bytes:		newMetricVec("pzsvc_exec_transfer_bytes_total", "Bytes of input retrieved and output uploaded.", nil, "service", "direction"),
+		pzCalls:	newMetricVec("pzsvc_exec_piazza_requests_total", "Calls made to Piazza, by endpoint and response status.", nil, "method", "endpoint", "status"),
+		pzLatency:	newMetricVec("pzsvc_exec_piazza_request_duration_seconds", "Latency of calls made to Piazza, by endpoint.", pzBuckets, "method", "endpoint") }
+}
+
+// observeRun records the outcome of a run.  Stages the run did not reach
+// are left out.
+func (met *metrics) observeRun(svcName string, output *outStruct) {
+	outcome := "success"
+	if len(output.Errors) != 0 {
+		outcome = "error"
+	}
+	exitCode := "none"
+	if output.exitCode >= 0 {
+		exitCode = strconv.Itoa(output.exitCode)
+	}
+	var inBytes, outBytes int64
+	for _, sum := range output.InSums {
+		inBytes += sum.Size
+	}
+	for _, sum := range output.OutSums {
+		outBytes += sum.Size
+	}
+
+	times := output.times
+	met.mu.Lock()
+	defer met.mu.Unlock()
+	met.runs.add(1, svcName, outcome, exitCode)
+	met.bytes.add(float64(inBytes), svcName, "in")
+	met.bytes.add(float64(outBytes), svcName, "out")
+	observeStage := func(stage string, from, to time.Time) {
+		if !from.IsZero() && !to.IsZero() {
+			met.stages.observe(to.Sub(from).Seconds(), svcName, stage)
+		}
+	}
+	observeStage("download", times.start, times.downloaded)
+	observeStage("exec", times.downloaded, times.executed)
+	observeStage("ingest", times.executed, times.finished)
+}
+
+// observePz records a call to Piazza.  It is registered with the pzsvc
+// library through SetCallObserver.
+func (met *metrics) observePz(info pzsvc.CallInfo) {
+	status := "error"
+	if info.Status != 0 {
+		status = strconv.Itoa(info.Status)
+	}
+	met.mu.Lock()
+	defer met.mu.Unlock()
+	met.pzCalls.add(1, info.Method, info.Endpoint, status)
+	met.pzLatency.observe(info.Duration.Seconds(), info.Method, info.Endpoint)
+}
+
+// handleMetrics serves the /metrics endpoint.
+func (met *metrics) handleMetrics(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	inFlight, queued := met.limiter.counts()
+	writeGauge(w, "pzsvc_exec_runs_in_flight", "Runs currently being carried out.", inFlight)
+	writeGauge(w, "pzsvc_exec_runs_queued", "Runs waiting on the MaxRuns limit.", queued)
+
+	met.mu.Lock()
+	defer met.mu.Unlock()
+	for _, vec := range []*metricVec{met.runs, met.stages, met.bytes, met.pzCalls, met.pzLatency} {
+		vec.write(w)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, val int) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, val)
+}
+
+// metricVec is a counter (if buckets is nil) or a histogram, broken down by
+// the given labels.  Callers are responsible for locking.
+type metricVec struct {
+	name	string
+	help	string
+	labels	[]string
+	buckets	[]float64
+	series	map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelVals	[]string
+	value		float64		// counter value, or histogram sum
+	count		uint64
+	bucketCnts	[]uint64
+}
+
+func newMetricVec(name, help string, buckets []float64, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*metricSeries)}
+}
+
+func (vec *metricVec) get(labelVals []string) *metricSeries {
+	key := strings.Join(labelVals, "\xff")
+	series, ok := vec.series[key]
+	if !ok {
+		series = &metricSeries{labelVals: labelVals, bucketCnts: make([]uint64, len(vec.buckets))}
+		vec.series[key] = series
+	}
+	return series
+}
+
+func (vec *metricVec) add(val float64, labelVals ...string) {
+	vec.get(labelVals).value += val
+}
+
+func (vec *metricVec) observe(val float64, labelVals ...string) {
+	series := vec.get(labelVals)
+	series.value += val
+	series.count++
+	for i, bound := range vec.buckets {
+		if val <= bound {
+			series.bucketCnts[i]++
+		}
+	}
+}
+
+func (vec *metricVec) write(w io.Writer) {
+	mType := "counter"
+	if vec.buckets != nil {
+		mType = "histogram"
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", vec.name, vec.help, vec.name, mType)
+
+	keys := make([]string, 0, len(vec.series))
+	for key := range vec.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := vec.series[key]
+		labelStr := vec.labelString(series.labelVals)
+		if vec.buckets == nil {
+			fmt.Fprintf(w, "%s{%s} %s\n", vec.name, labelStr, formatFloat(series.value))
+			continue
+		}
+		for i, bound := range vec.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", vec.name, labelStr, formatFloat(bound), series.bucketCnts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", vec.name, labelStr, series.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", vec.name, labelStr, formatFloat(series.value))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", vec.name, labelStr, series.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (vec *metricVec) labelString(labelVals []string) string {
+	pairs := make([]string, len(vec.labels))
+	for i, label := range vec.labels {
+		pairs[i] = label + `="` + labelEscaper.Replace(labelVals[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func formatFloat(val float64) string {
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
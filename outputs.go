@@ -0,0 +1,177 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/venicegeo/pzsvc-exec/pzsvc"
+)
+
+// inlineFile is an output file returned directly in the response.  Text
+// content is embedded as-is, and anything else is base64 encoded.
+type inlineFile struct {
+	Encoding	string	// "raw" or "base64"
+	Content		string
+}
+
+// readInline reads an output file for return in the response, provided that
+// it is no larger than maxBytes.
+func readInline(runID, fName string, maxBytes int64) (inlineFile, pzsvc.FileSum, error) {
+	fPath, err := outPath(runID, fName)
+	if err != nil {
+		return inlineFile{}, pzsvc.FileSum{}, err
+	}
+	info, err := os.Stat(fPath)
+	if err != nil {
+		return inlineFile{}, pzsvc.FileSum{}, err
+	}
+	if info.Size() > maxBytes {
+		return inlineFile{}, pzsvc.FileSum{}, fmt.Errorf(`Output %s is %d bytes, which exceeds the inline limit of %d.`, fName, info.Size(), maxBytes)
+	}
+
+	fData, err := ioutil.ReadFile(fPath)
+	if err != nil {
+		return inlineFile{}, pzsvc.FileSum{}, err
+	}
+	sum := pzsvc.SumBytes(fData)
+	if utf8.Valid(fData) {
+		return inlineFile{"raw", string(fData)}, sum, nil
+	}
+	return inlineFile{"base64", base64.StdEncoding.EncodeToString(fData)}, sum, nil
+}
+
+// outPath resolves an output filename from the request to a path within
+// the run folder, refusing anything that would reach outside of it.
+func outPath(runID, fName string) (string, error) {
+	clean := filepath.Clean(fName)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf(`Invalid output filename "%s".`, fName)
+	}
+	return filepath.Join(runID, clean), nil
+}
+
+// buildArchive zips up the output files matching the given names and glob
+// patterns into a single archive in the run folder, and returns its
+// manifest.
+func buildArchive(runID, archName string, patterns []string) ([]pzsvc.ManifestEntry, error) {
+	archPath, err := outPath(runID, archName)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var files []string
+	for _, pattern := range patterns {
+		globPath, err := outPath(runID, pattern)
+		if err != nil {
+			return nil, err
+		}
+		matches, err := filepath.Glob(globPath)
+		if err != nil {
+			return nil, fmt.Errorf(`Invalid outArchive pattern "%s".`, pattern)
+		}
+		count := 0
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil || !info.Mode().IsRegular() || match == archPath {
+				continue
+			}
+			rel, err := filepath.Rel(runID, match)
+			if err != nil {
+				return nil, err
+			}
+			count++
+			if !seen[rel] {
+				seen[rel] = true
+				files = append(files, rel)
+			}
+		}
+		if count == 0 {
+			return nil, fmt.Errorf(`outArchive entry "%s" matched no files.`, pattern)
+		}
+	}
+	sort.Strings(files)
+
+	return pzsvc.ZipFiles(runID, files, archPath)
+}
+
+// outMetaReq is the caller's description of a single output file, as given
+// in the outMeta request parameter.  Empty fields fall back to defaults.
+// Classification is deliberately not among them: that is always the
+// operator's Classification config entry.
+type outMetaReq struct {
+	Name		string
+	Description	string
+	Metadata	map[string]string
+}
+
+// parseOutMeta reads the outMeta request parameter: a JSON object mapping
+// output filenames to their descriptions.
+func parseOutMeta(param string) (map[string]outMetaReq, error) {
+	outMeta := make(map[string]outMetaReq)
+	if param == "" {
+		return outMeta, nil
+	}
+	err := json.Unmarshal([]byte(param), &outMeta)
+	if err != nil {
+		return nil, fmt.Errorf(`Could not interpret outMeta: %s`, err.Error())
+	}
+	return outMeta, nil
+}
+
+// buildResMeta puts together the Piazza metadata for an output file.  The
+// metadata map is layered: the config's IngestMetadata templates first, then
+// whatever the caller supplied, then the entries pzsvc-exec sets itself
+// (sysProps), which cannot be overridden.
+func buildResMeta(fName, fType, runID, version string, configObj configType, req outMetaReq, sysProps ...map[string]string) pzsvc.ResMeta {
+	rMeta := pzsvc.ResMeta{Name: req.Name, Description: req.Description, Method: "POST", Version: version}
+	if rMeta.Name == "" {
+		rMeta.Name = fName
+	}
+	if rMeta.Description == "" {
+		rMeta.Description = fmt.Sprintf("%s uploaded by %s.", fType, configObj.SvcName)
+	}
+	rMeta.ClassType.Classification = configObj.Classification
+
+	tmplVars := strings.NewReplacer(
+		"{{svcName}}", configObj.SvcName,
+		"{{version}}", version,
+		"{{runId}}", runID,
+		"{{fileName}}", fName,
+		"{{fileType}}", fType)
+
+	rMeta.Metadata = make(map[string]string)
+	for key, val := range configObj.IngestMetadata {
+		rMeta.Metadata[key] = tmplVars.Replace(val)
+	}
+	for key, val := range req.Metadata {
+		rMeta.Metadata[key] = val
+	}
+	for _, props := range sysProps {
+		for key, val := range props {
+			rMeta.Metadata[key] = val
+		}
+	}
+	return rMeta
+}
@@ -0,0 +1,172 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/venicegeo/pzsvc-exec/pzsvc"
+)
+
+// provDoc is a provenance record for a single run, in the PROV-JSON format
+// (https://www.w3.org/Submission/prov-json/).  The run is the activity, its
+// inputs and outputs are entities, and this service is the agent.
+type provDoc struct {
+	Prefix			map[string]string		`json:"prefix"`
+	Entity			map[string]provAttrs	`json:"entity,omitempty"`
+	Activity		map[string]provAttrs	`json:"activity"`
+	Agent			map[string]provAttrs	`json:"agent"`
+	Used			map[string]provAttrs	`json:"used,omitempty"`
+	WasGeneratedBy		map[string]provAttrs	`json:"wasGeneratedBy,omitempty"`
+	WasAssociatedWith	map[string]provAttrs	`json:"wasAssociatedWith"`
+}
+
+type provAttrs map[string]interface{}
+
+// runTimes records when each stage of a run finished.
+type runTimes struct {
+	start		time.Time
+	downloaded	time.Time
+	executed	time.Time
+	finished	time.Time
+}
+
+const provTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// buildProv assembles the provenance record of a completed run.
+func buildProv(runID, version string, configObj configType, argv, inSources []string, output *outStruct, times runTimes) *provDoc {
+	runKey := "pzsvc:run/" + runID
+	agentKey := "pzsvc:service/" + configObj.SvcName
+	host, _ := os.Hostname()
+
+	doc := provDoc{
+		Prefix:		map[string]string{"pzsvc": "https://github.com/venicegeo/pzsvc-exec#"},
+		Entity:		make(map[string]provAttrs),
+		Used:		make(map[string]provAttrs),
+		WasGeneratedBy:	make(map[string]provAttrs)}
+
+	doc.Activity = map[string]provAttrs{runKey: {
+		"prov:startTime":	times.start.UTC().Format(provTimeFormat),
+		"prov:endTime":		times.finished.UTC().Format(provTimeFormat),
+		"pzsvc:argv":		argv,
+		"pzsvc:configHash":	configHash(configObj),
+		"pzsvc:version":	version,
+		"pzsvc:host":		host,
+		"pzsvc:downloadSecs":	times.downloaded.Sub(times.start).Seconds(),
+		"pzsvc:execSecs":	times.executed.Sub(times.downloaded).Seconds(),
+		"pzsvc:uploadSecs":	times.finished.Sub(times.executed).Seconds()}}
+	doc.Agent = map[string]provAttrs{agentKey: {
+		"prov:type":		"prov:SoftwareAgent",
+		"pzsvc:name":		configObj.SvcName,
+		"pzsvc:cliCmd":		configObj.CliCmd,
+		"pzsvc:version":	version}}
+	doc.WasAssociatedWith = map[string]provAttrs{"_:assoc": {
+		"prov:activity":	runKey,
+		"prov:agent":		agentKey}}
+
+	isSource := make(map[string]bool)
+	for _, source := range inSources {
+		isSource[source] = true
+	}
+
+	// InSums covers both the inFiles sources and any uploaded files.
+	for i, source := range sortedKeys(output.InSums) {
+		entKey := "pzsvc:input/" + source
+		sum := output.InSums[source]
+		attrs := provAttrs{
+			"pzsvc:source":		source,
+			"pzsvc:fileName":	output.InFiles[source],
+			"pzsvc:size":		sum.Size,
+			"pzsvc:sha256":		sum.SHA256}
+		if isSource[source] && pzsvc.SourceScheme(source) == "" {
+			attrs["pzsvc:dataId"] = source
+		}
+		doc.Entity[entKey] = attrs
+		doc.Used[fmt.Sprintf("_:used%d", i)] = provAttrs{"prov:activity": runKey, "prov:entity": entKey}
+	}
+
+	for i, fName := range sortedKeys(output.OutSums) {
+		entKey := "pzsvc:output/" + fName
+		sum := output.OutSums[fName]
+		attrs := provAttrs{
+			"pzsvc:fileName":	fName,
+			"pzsvc:size":		sum.Size,
+			"pzsvc:sha256":		sum.SHA256}
+		if dataID, ok := output.OutFiles[fName]; ok {
+			attrs["pzsvc:dataId"] = dataID
+		}
+		doc.Entity[entKey] = attrs
+		doc.WasGeneratedBy[fmt.Sprintf("_:gen%d", i)] = provAttrs{"prov:entity": entKey, "prov:activity": runKey}
+	}
+
+	return &doc
+}
+
+// ingestProv stores the provenance record in Piazza as a text resource, and
+// then points each of the run's uploaded outputs at it.  Returns the dataId
+// of the record.
+func ingestProv(doc *provDoc, runID, version string, configObj configType, authKey string, output *outStruct) (string, error) {
+	docBytes, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	rMeta := buildResMeta("provenance-" + runID + ".json", "text", runID, version, configObj,
+							outMetaReq{Description: "Provenance record for run " + runID + " of " + configObj.SvcName + "."},
+							map[string]string{"runId": runID, "algoName": configObj.SvcName})
+	provID, err := pzsvc.IngestMeta("provenance-" + runID + ".json", "text", configObj.PzAddr, authKey, docBytes, rMeta)
+	if err != nil {
+		return "", err
+	}
+
+	for _, fName := range sortedKeys(output.OutFiles) {
+		err = pzsvc.UpdateFileMeta(output.OutFiles[fName], configObj.PzAddr, authKey, map[string]string{"provenanceDataId": provID})
+		if err != nil {
+			return provID, err
+		}
+	}
+	return provID, nil
+}
+
+// configHash identifies the configuration a run was performed under.
+func configHash(configObj configType) string {
+	configBytes, err := json.Marshal(configObj)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(configBytes)
+	return hex.EncodeToString(sum[:])
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch typed := m.(type) {
+	case map[string]string:
+		for key := range typed {
+			keys = append(keys, key)
+		}
+	case map[string]pzsvc.FileSum:
+		for key := range typed {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,251 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pzsvc
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxArchiveEntries caps the number of entries Extract will handle from a
+// single archive.
+const maxArchiveEntries = 10000
+
+// Extract unpacks the zip, tar or tar.gz archive at fPath into destDir.  The
+// format is determined from the file contents rather than the name.  Entries
+// that would land outside of destDir, entries that already exist, and
+// anything other than plain files and directories are rejected, as is an
+// archive whose contents total more than maxBytes once uncompressed.  It
+// returns the paths of the files extracted, relative to destDir.
+func Extract(fPath, destDir string, maxBytes int64) ([]string, error) {
+	file, err := os.Open(fPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 512)
+	n, _ := io.ReadFull(file, header)
+	header = header[:n]
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	ex := extractor{destDir: destDir, remaining: maxBytes}
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")):
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		err = ex.unzip(file, info.Size())
+		return ex.files, err
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		gzReader, err := gzip.NewReader(bufio.NewReader(file))
+		if err != nil {
+			return nil, err
+		}
+		defer gzReader.Close()
+		err = ex.untar(gzReader)
+		return ex.files, err
+	case len(header) >= 262 && string(header[257:262]) == "ustar":
+		err = ex.untar(file)
+		return ex.files, err
+	}
+	return nil, fmt.Errorf(`%s is not a recognized archive.  Supported formats are zip, tar and tar.gz.`, filepath.Base(fPath))
+}
+
+type extractor struct {
+	destDir   string
+	remaining int64
+	files     []string
+}
+
+func (ex *extractor) unzip(in io.ReaderAt, size int64) error {
+	zReader, err := zip.NewReader(in, size)
+	if err != nil {
+		return err
+	}
+	if len(zReader.File) > maxArchiveEntries {
+		return fmt.Errorf(`Archive has more than %d entries.`, maxArchiveEntries)
+	}
+	for _, zFile := range zReader.File {
+		mode := zFile.Mode()
+		if mode.IsDir() {
+			if err = ex.mkdir(zFile.Name); err != nil {
+				return err
+			}
+			continue
+		}
+		if !mode.IsRegular() {
+			return fmt.Errorf(`Archive entry %s is not a regular file.`, zFile.Name)
+		}
+		rc, err := zFile.Open()
+		if err != nil {
+			return err
+		}
+		err = ex.write(zFile.Name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ex *extractor) untar(in io.Reader) error {
+	tReader := tar.NewReader(in)
+	for count := 0; ; count++ {
+		if count > maxArchiveEntries {
+			return fmt.Errorf(`Archive has more than %d entries.`, maxArchiveEntries)
+		}
+		header, err := tReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = ex.mkdir(header.Name)
+		case tar.TypeReg:
+			err = ex.write(header.Name, tReader)
+		case tar.TypeXGlobalHeader:
+			// metadata only
+		default:
+			err = fmt.Errorf(`Archive entry %s is not a regular file.`, header.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// entryPath resolves an archive entry name to a path within destDir,
+// refusing any entry that would escape it ("zip slip").
+func (ex *extractor) entryPath(name string) (string, string, error) {
+	rel := filepath.Clean(filepath.FromSlash(strings.Replace(name, `\`, "/", -1)))
+	if filepath.IsAbs(rel) || filepath.VolumeName(rel) != "" || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", "", fmt.Errorf(`Archive entry %s would extract outside of the run folder.`, name)
+	}
+	return filepath.Join(ex.destDir, rel), filepath.ToSlash(rel), nil
+}
+
+func (ex *extractor) mkdir(name string) error {
+	dPath, _, err := ex.entryPath(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(dPath, 0777)
+}
+
+func (ex *extractor) write(name string, in io.Reader) error {
+	fPath, rel, err := ex.entryPath(name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(fPath), 0777); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(fPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		return fmt.Errorf(`Archive entry %s collides with an existing file.`, name)
+	}
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(out, io.LimitReader(in, ex.remaining+1))
+	if cErr := out.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return err
+	}
+	if written > ex.remaining {
+		return fmt.Errorf(`Archive exceeds the uncompressed size limit.`)
+	}
+	ex.remaining -= written
+	ex.files = append(ex.files, rel)
+	return nil
+}
+
+// ManifestEntry describes a single file within an archive built by ZipFiles.
+type ManifestEntry struct {
+	Name string `json:"name"`
+	FileSum
+}
+
+// ZipFiles builds a zip archive at destPath from the given files, which are
+// named relative to baseDir and keep those relative names within the
+// archive.  It returns a manifest of the archive's contents.
+func ZipFiles(baseDir string, files []string, destPath string) ([]ManifestEntry, error) {
+	out, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := writeZip(out, baseDir, files)
+	if cErr := out.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(destPath)
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func writeZip(out io.Writer, baseDir string, files []string) ([]ManifestEntry, error) {
+	zWriter := zip.NewWriter(out)
+	manifest := make([]ManifestEntry, 0, len(files))
+	for _, fName := range files {
+		in, err := os.Open(filepath.Join(baseDir, fName))
+		if err != nil {
+			return nil, err
+		}
+		info, err := in.Stat()
+		if err != nil {
+			in.Close()
+			return nil, err
+		}
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			in.Close()
+			return nil, err
+		}
+		header.Name = filepath.ToSlash(fName)
+		header.Method = zip.Deflate
+		part, err := zWriter.CreateHeader(header)
+		if err != nil {
+			in.Close()
+			return nil, err
+		}
+		sum, err := CopySum(part, in)
+		in.Close()
+		if err != nil {
+			return nil, err
+		}
+		manifest = append(manifest, ManifestEntry{header.Name, sum})
+	}
+	return manifest, zWriter.Close()
+}
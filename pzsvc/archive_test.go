@@ -0,0 +1,194 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pzsvc
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// archEntry is a single entry of a test archive.  Entries with a name
+// ending in "/" are directories, and entries with a link are symlinks.
+type archEntry struct {
+	name    string
+	content string
+	link    string
+}
+
+func makeZip(t *testing.T, entries []archEntry) []byte {
+	var buf bytes.Buffer
+	zWriter := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		content := entry.content
+		if entry.link != "" {
+			header.SetMode(os.ModeSymlink | 0777)
+			content = entry.link
+		}
+		part, err := zWriter.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(content))
+	}
+	if err := zWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeTar(t *testing.T, entries []archEntry, compress bool) []byte {
+	var buf bytes.Buffer
+	var gzWriter *gzip.Writer
+	tWriter := tar.NewWriter(&buf)
+	if compress {
+		gzWriter = gzip.NewWriter(&buf)
+		tWriter = tar.NewWriter(gzWriter)
+	}
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0666, Size: int64(len(entry.content)), Typeflag: tar.TypeReg}
+		switch {
+		case entry.link != "":
+			header.Typeflag, header.Linkname, header.Size = tar.TypeSymlink, entry.link, 0
+		case entry.name[len(entry.name)-1] == '/':
+			header.Typeflag, header.Mode = tar.TypeDir, 0777
+		}
+		if err := tWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		tWriter.Write([]byte(entry.content))
+	}
+	if err := tWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gzWriter != nil {
+		gzWriter.Close()
+	}
+	return buf.Bytes()
+}
+
+// extractTest writes the archive out and extracts it into a "run" folder
+// within a fresh temp dir, returning the run folder along with the results.
+func extractTest(t *testing.T, arch []byte, maxBytes int64, existing ...string) (string, []string, error) {
+	baseDir, err := ioutil.TempDir("", "pzsvc-extract-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archPath := filepath.Join(baseDir, "in.arch")
+	runDir := filepath.Join(baseDir, "run")
+	if err = ioutil.WriteFile(archPath, arch, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(runDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, fName := range existing {
+		if err = ioutil.WriteFile(filepath.Join(runDir, fName), []byte("original"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := Extract(archPath, runDir, maxBytes)
+	return runDir, files, err
+}
+
+func TestExtract(t *testing.T) {
+	good := []archEntry{{name: "a.txt", content: "aaaa"}, {name: "sub/"}, {name: "sub/b.txt", content: "bb"}}
+	for format, arch := range map[string][]byte{
+		"zip":    makeZip(t, good),
+		"tar":    makeTar(t, good, false),
+		"tar.gz": makeTar(t, good, true)} {
+
+		runDir, files, err := extractTest(t, arch, 1024)
+		defer os.RemoveAll(filepath.Dir(runDir))
+		if err != nil {
+			t.Errorf(`%s: Extract failed: %s`, format, err.Error())
+			continue
+		}
+		sort.Strings(files)
+		if !reflect.DeepEqual(files, []string{"a.txt", "sub/b.txt"}) {
+			t.Errorf(`%s: Extract returned %q.`, format, files)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(runDir, "sub", "b.txt"))
+		if err != nil || string(content) != "bb" {
+			t.Errorf(`%s: sub/b.txt holds %q (%v).`, format, content, err)
+		}
+	}
+}
+
+func TestExtractRejects(t *testing.T) {
+	tests := []struct {
+		desc     string
+		entries  []archEntry
+		maxBytes int64
+		existing []string
+	}{
+		{"parent dir", []archEntry{{name: "../evil.txt", content: "x"}}, 1024, nil},
+		{"nested parent dir", []archEntry{{name: "sub/../../evil.txt", content: "x"}}, 1024, nil},
+		{"absolute", []archEntry{{name: "/tmp/evil.txt", content: "x"}}, 1024, nil},
+		{"backslash parent dir", []archEntry{{name: `..\evil.txt`, content: "x"}}, 1024, nil},
+		{"backslash nested", []archEntry{{name: `sub\..\..\evil.txt`, content: "x"}}, 1024, nil},
+		{"symlink", []archEntry{{name: "link", link: "/etc/passwd"}}, 1024, nil},
+		{"size limit", []archEntry{{name: "a.txt", content: "0123456789"}, {name: "b.txt", content: "0123456789"}}, 15, nil},
+		{"existing file", []archEntry{{name: "a.txt", content: "replaced"}}, 1024, []string{"a.txt"}},
+		{"duplicate entry", []archEntry{{name: "a.txt", content: "1"}, {name: "a.txt", content: "2"}}, 1024, nil},
+	}
+	for _, test := range tests {
+		for format, arch := range map[string][]byte{
+			"zip": makeZip(t, test.entries),
+			"tar": makeTar(t, test.entries, false)} {
+
+			runDir, _, err := extractTest(t, arch, test.maxBytes, test.existing...)
+			baseDir := filepath.Dir(runDir)
+			if err == nil {
+				t.Errorf(`%s, %s: Extract succeeded.  Expected an error.`, test.desc, format)
+			}
+			if _, sErr := os.Stat(filepath.Join(baseDir, "evil.txt")); sErr == nil {
+				t.Errorf(`%s, %s: file written outside of the run folder.`, test.desc, format)
+			}
+			for _, fName := range test.existing {
+				content, _ := ioutil.ReadFile(filepath.Join(runDir, fName))
+				if string(content) != "original" {
+					t.Errorf(`%s, %s: existing file %s overwritten.`, test.desc, format, fName)
+				}
+			}
+			os.RemoveAll(baseDir)
+		}
+	}
+}
+
+func TestExtractSizeLimit(t *testing.T) {
+	entries := []archEntry{{name: "a.txt", content: "0123456789"}, {name: "b.txt", content: "0123456789"}}
+	runDir, files, err := extractTest(t, makeZip(t, entries), 20)
+	defer os.RemoveAll(filepath.Dir(runDir))
+	if err != nil || len(files) != 2 {
+		t.Errorf(`Extract at exactly the size limit returned %q, %v.`, files, err)
+	}
+}
+
+func TestExtractNotArchive(t *testing.T) {
+	runDir, _, err := extractTest(t, []byte("just some text"), 1024)
+	defer os.RemoveAll(filepath.Dir(runDir))
+	if err == nil {
+		t.Error(`Extract of a plain file succeeded.  Expected an error.`)
+	}
+}
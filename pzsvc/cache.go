@@ -0,0 +1,357 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pzsvc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Cache is an on-disk cache of files downloaded from Piazza, keyed by
+// dataId.  Cached files are hardlinked (or copied, where linking is not
+// possible) into the requesting folder.  Total size is held under MaxBytes
+// by evicting the least recently used entries, and entries older than TTL
+// are refetched.  Concurrent requests for the same dataId share a single
+// download.  Because of the hardlinks, cached files are made read-only, so
+// that a program cannot modify its inputs in place and so alter the cache
+// for later runs.
+type Cache struct {
+	Dir      string
+	MaxBytes int64         // zero for no size limit
+	TTL      time.Duration // zero for no expiry
+
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry
+	inflight map[string]*cacheCall
+	size     int64
+}
+
+type cacheEntry struct {
+	fPath    string
+	sum      FileSum
+	fetched  time.Time
+	lastUsed time.Time
+	authOK   map[string]bool // hashes of auth keys known to have access
+}
+
+// sumFile is the name of the checksum record within each entry folder.
+const sumFile = ".sum.json"
+
+// cachedFileMode is the permissions of cached files.
+const cachedFileMode = 0444
+
+type cacheCall struct {
+	done  chan struct{}
+	entry *cacheEntry
+	err   error
+}
+
+// NewCache creates a Cache in the given directory, picking up any entries
+// left there by previous runs.
+func NewCache(dir string, maxBytes int64, ttl time.Duration) (*Cache, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cache{Dir: dir, MaxBytes: maxBytes, TTL: ttl,
+		entries:  make(map[string]*cacheEntry),
+		inflight: make(map[string]*cacheCall)}
+
+	subDirs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, subDir := range subDirs {
+		if !subDir.IsDir() {
+			continue
+		}
+		if subDir.Name()[0] == '.' {
+			// leftover from an interrupted download
+			os.RemoveAll(filepath.Join(dir, subDir.Name()))
+			continue
+		}
+		entry, err := loadEntry(filepath.Join(dir, subDir.Name()))
+		if err != nil {
+			os.RemoveAll(filepath.Join(dir, subDir.Name()))
+			continue
+		}
+		c.entries[subDir.Name()] = entry
+		c.size += entry.sum.Size
+	}
+	c.evict("")
+	return c, nil
+}
+
+// Download has the same semantics as the package-level Download, but
+// serves the file from the cache when possible.
+func (c *Cache) Download(dataID, subFold, pzAddr, authKey string) (string, error) {
+	fName, _, err := c.DownloadSum(dataID, subFold, pzAddr, authKey)
+	return fName, err
+}
+
+// DownloadSum has the same semantics as the package-level DownloadSum, but
+// serves the file from the cache when possible.
+func (c *Cache) DownloadSum(dataID, subFold, pzAddr, authKey string) (string, FileSum, error) {
+	fName, sum, _, err := c.DownloadMeta(dataID, subFold, pzAddr, authKey)
+	return fName, sum, err
+}
+
+// DownloadMeta has the same semantics as the package-level DownloadMeta, but
+// serves the file from the cache when possible.  The metadata is only returned
+// where it had to be retrieved anyway: when the file was downloaded, or when
+// this caller's access to it had to be checked.  Otherwise, it is nil.
+func (c *Cache) DownloadMeta(dataID, subFold, pzAddr, authKey string) (string, FileSum, *DataResource, error) {
+	key := entryKey(dataID, pzAddr)
+	authHash := cacheKey(authKey)
+
+	for attempt := 0; ; attempt++ {
+		entry, dataRes, err := c.getEntry(key, dataID, pzAddr, authKey)
+		if err != nil {
+			return "", FileSum{}, nil, err
+		}
+
+		c.mu.Lock()
+		known := entry.authOK[authHash]
+		c.mu.Unlock()
+		if !known {
+			// cached content was fetched under someone else's credentials.
+			// Confirm that this caller is permitted to see it.
+			dataRes, err = GetFileMeta(dataID, pzAddr, authKey)
+			if err != nil {
+				return "", FileSum{}, nil, err
+			}
+			c.mu.Lock()
+			entry.authOK[authHash] = true
+			c.mu.Unlock()
+		}
+
+		fName := filepath.Base(entry.fPath)
+		dest := locString(subFold, fName)
+		err = os.Link(entry.fPath, dest)
+		if os.IsExist(err) {
+			// Download overwrites existing files, and so do we.
+			os.Remove(dest)
+			err = os.Link(entry.fPath, dest)
+		}
+		if err != nil {
+			err = copyFile(entry.fPath, dest, entry.sum)
+		}
+		// the entry may have been evicted out from under us.  If so,
+		// try once more.
+		if err == nil || !os.IsNotExist(err) || attempt > 0 {
+			if err != nil {
+				return "", FileSum{}, nil, err
+			}
+			return fName, entry.sum, dataRes, nil
+		}
+	}
+}
+
+// getEntry returns a current cache entry for the given dataId, downloading
+// it if necessary.  Only one download per key is performed at a time.  The
+// metadata retrieved along with the download is returned to the caller that
+// performed it.  Callers that waited on a download that failed try again
+// themselves, as the failure may be down to the other caller's credentials.
+func (c *Cache) getEntry(key, dataID, pzAddr, authKey string) (*cacheEntry, *DataResource, error) {
+	c.mu.Lock()
+	for {
+		if entry, ok := c.entries[key]; ok {
+			if c.TTL == 0 || time.Since(entry.fetched) < c.TTL {
+				entry.lastUsed = time.Now()
+				c.mu.Unlock()
+				return entry, nil, nil
+			}
+			c.remove(key)
+		}
+		call, ok := c.inflight[key]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		<-call.done
+		if call.err == nil {
+			return call.entry, nil, nil
+		}
+		c.mu.Lock()
+	}
+	call := &cacheCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.mu.Unlock()
+
+	var dataRes *DataResource
+	call.entry, dataRes, call.err = c.fetch(key, dataID, pzAddr, authKey)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if call.err == nil {
+		c.entries[key] = call.entry
+		c.size += call.entry.sum.Size
+		c.evict(key)
+	}
+	c.mu.Unlock()
+	close(call.done)
+
+	return call.entry, dataRes, call.err
+}
+
+// fetch downloads the file into a temporary folder, then moves the folder
+// into place so that partial downloads are never visible in the cache.
+func (c *Cache) fetch(key, dataID, pzAddr, authKey string) (*cacheEntry, *DataResource, error) {
+	tmpDir, err := ioutil.TempDir(c.Dir, ".dl-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fName, sum, dataRes, err := DownloadMeta(dataID, tmpDir, pzAddr, authKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = os.Chmod(filepath.Join(tmpDir, fName), cachedFileMode)
+	if err != nil {
+		return nil, nil, err
+	}
+	sumBytes, err := json.Marshal(sum)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = ioutil.WriteFile(filepath.Join(tmpDir, sumFile), sumBytes, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entDir := filepath.Join(c.Dir, key)
+	os.RemoveAll(entDir)
+	err = os.Rename(tmpDir, entDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	return &cacheEntry{fPath: filepath.Join(entDir, fName), sum: sum, fetched: now, lastUsed: now,
+		authOK: map[string]bool{cacheKey(authKey): true}}, dataRes, nil
+}
+
+// loadEntry reads a cache entry left on disk by a previous run.  Each entry
+// folder holds the cached file and a record of its checksum.
+func loadEntry(entDir string) (*cacheEntry, error) {
+	files, err := ioutil.ReadDir(entDir)
+	if err != nil {
+		return nil, err
+	}
+	var entry *cacheEntry
+	for _, file := range files {
+		if file.Name() == sumFile {
+			continue
+		}
+		if entry != nil || file.IsDir() {
+			return nil, fmt.Errorf(`Unexpected contents in cache folder %s.`, entDir)
+		}
+		entry = &cacheEntry{
+			fPath:    filepath.Join(entDir, file.Name()),
+			fetched:  file.ModTime(),
+			lastUsed: file.ModTime(),
+			authOK:   make(map[string]bool)}
+	}
+	if entry == nil {
+		return nil, fmt.Errorf(`Empty cache folder %s.`, entDir)
+	}
+
+	sumBytes, err := ioutil.ReadFile(filepath.Join(entDir, sumFile))
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(sumBytes, &entry.sum)
+	if err != nil {
+		return nil, err
+	}
+	// entries from older versions may still be writable.
+	err = os.Chmod(entry.fPath, cachedFileMode)
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// evict removes least recently used entries until the cache fits within
+// MaxBytes.  The entry under keep is never evicted, so that a file larger
+// than the cache can still be delivered once.  Must be called with c.mu held.
+func (c *Cache) evict(keep string) {
+	for c.MaxBytes > 0 && c.size > c.MaxBytes {
+		var oldKey string
+		var oldTime time.Time
+		for key, entry := range c.entries {
+			if key != keep && (oldKey == "" || entry.lastUsed.Before(oldTime)) {
+				oldKey, oldTime = key, entry.lastUsed
+			}
+		}
+		if oldKey == "" {
+			return
+		}
+		c.remove(oldKey)
+	}
+}
+
+// remove drops an entry from the cache and from the disk.  Run folders
+// holding hardlinks to the file are unaffected.  Must be called with c.mu
+// held.
+func (c *Cache) remove(key string) {
+	entry, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	delete(c.entries, key)
+	c.size -= entry.sum.Size
+	os.RemoveAll(filepath.Dir(entry.fPath))
+}
+
+// copyFile copies src to dest, confirming that the result matches the
+// expected checksum.
+func copyFile(src, dest string, expSum FileSum) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	sum, err := writeFile(dest, in, expSum.Size)
+	if err == nil && sum != expSum {
+		os.Remove(dest)
+		err = fmt.Errorf(`Checksum mismatch copying %s from cache.`, src)
+	}
+	return err
+}
+
+// entryKey is the cache key for a dataId.  DataIds are only unique within
+// a single Pz instance, so the address is part of the key.
+func entryKey(dataID, pzAddr string) string {
+	return cacheKey(pzAddr + " " + dataID)
+}
+
+func cacheKey(str string) string {
+	sum := sha256.Sum256([]byte(str))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,274 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pzsvc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePz stands in for Pz's file and data endpoints.  Each dataId's file
+// holds "content of <dataId>\n", and requests with the auth key "denied"
+// are refused.  With "slow-denied", they are refused after a delay.
+type fakePz struct {
+	*httptest.Server
+	mu        sync.Mutex
+	downloads map[string]int
+}
+
+func newFakePz() *fakePz {
+	fp := &fakePz{downloads: make(map[string]int)}
+	fp.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "slow-denied":
+			time.Sleep(200 * time.Millisecond)
+			fallthrough
+		case "denied":
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/file/"):
+			dataID := r.URL.Path[len("/file/"):]
+			fp.mu.Lock()
+			fp.downloads[dataID]++
+			fp.mu.Unlock()
+			w.Header().Set("Content-Disposition", `attachment; filename="`+dataID+`.txt"`)
+			fmt.Fprintf(w, "content of %s\n", dataID)
+		case strings.HasPrefix(r.URL.Path, "/data/"):
+			dataID := r.URL.Path[len("/data/"):]
+			fmt.Fprintf(w, `{"type":"data","data":{"dataId":"%s","dataType":{"type":"text","location":{"fileSize":%d}}}}`,
+				dataID, len("content of \n")+len(dataID))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return fp
+}
+
+func (fp *fakePz) count(dataID string) int {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return fp.downloads[dataID]
+}
+
+// cacheTest sets up a fake Pz and a cache in a fresh temp dir.  The
+// returned function cleans up both.
+func cacheTest(t *testing.T, maxBytes int64, ttl time.Duration) (*fakePz, *Cache, string, func()) {
+	fp := newFakePz()
+	baseDir, err := ioutil.TempDir("", "pzsvc-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCache(filepath.Join(baseDir, "cache"), maxBytes, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fp, c, baseDir, func() {
+		fp.Close()
+		os.RemoveAll(baseDir)
+	}
+}
+
+// runDir makes a fresh folder to download into.
+func runDir(t *testing.T, baseDir string) string {
+	dir, err := ioutil.TempDir(baseDir, "run-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func cacheGet(t *testing.T, c *Cache, fp *fakePz, baseDir, dataID string) string {
+	dir := runDir(t, baseDir)
+	fName, sum, err := c.DownloadSum(dataID, dir, fp.URL, "key")
+	if err != nil {
+		t.Fatalf(`DownloadSum(%s) failed: %s`, dataID, err.Error())
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, fName))
+	if err != nil || string(content) != "content of "+dataID+"\n" {
+		t.Fatalf(`DownloadSum(%s) delivered %q (%v).`, dataID, content, err)
+	}
+	if sum != SumBytes(content) {
+		t.Errorf(`DownloadSum(%s) returned checksum %v for %v.`, dataID, sum, SumBytes(content))
+	}
+	return filepath.Join(dir, fName)
+}
+
+func TestCacheHit(t *testing.T) {
+	fp, c, baseDir, cleanup := cacheTest(t, 0, 0)
+	defer cleanup()
+
+	cacheGet(t, c, fp, baseDir, "a")
+	fPath := cacheGet(t, c, fp, baseDir, "a")
+	if n := fp.count("a"); n != 1 {
+		t.Errorf(`Downloaded %d times.  Expected once.`, n)
+	}
+
+	// the delivered file shares its inode with the cache, and so must not
+	// be writable.
+	info, err := os.Stat(fPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0222 != 0 {
+		t.Errorf(`Cached file delivered with mode %v.  Expected read-only.`, info.Mode().Perm())
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	fp, c, baseDir, cleanup := cacheTest(t, 0, time.Hour)
+	defer cleanup()
+
+	cacheGet(t, c, fp, baseDir, "a")
+	cacheGet(t, c, fp, baseDir, "a")
+	if n := fp.count("a"); n != 1 {
+		t.Fatalf(`Downloaded %d times within the TTL.  Expected once.`, n)
+	}
+
+	c.mu.Lock()
+	c.entries[entryKey("a", fp.URL)].fetched = time.Now().Add(-2 * time.Hour)
+	c.mu.Unlock()
+	cacheGet(t, c, fp, baseDir, "a")
+	if n := fp.count("a"); n != 2 {
+		t.Errorf(`Downloaded %d times after expiry.  Expected twice.`, n)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	// each file is 13 bytes, so two fit and three do not.
+	fp, c, baseDir, cleanup := cacheTest(t, 30, 0)
+	defer cleanup()
+
+	cacheGet(t, c, fp, baseDir, "a")
+	cacheGet(t, c, fp, baseDir, "b")
+	now := time.Now()
+	c.mu.Lock()
+	c.entries[entryKey("a", fp.URL)].lastUsed = now
+	c.entries[entryKey("b", fp.URL)].lastUsed = now.Add(-time.Minute)
+	c.mu.Unlock()
+
+	cacheGet(t, c, fp, baseDir, "c")
+	c.mu.Lock()
+	_, hasA := c.entries[entryKey("a", fp.URL)]
+	_, hasB := c.entries[entryKey("b", fp.URL)]
+	size := c.size
+	c.mu.Unlock()
+	if !hasA || hasB {
+		t.Errorf(`After eviction, a cached: %v, b cached: %v.  Expected only the least recently used, b, evicted.`, hasA, hasB)
+	}
+	if size > 30 {
+		t.Errorf(`Cache size %d exceeds MaxBytes.`, size)
+	}
+	if _, err := os.Stat(filepath.Join(c.Dir, entryKey("b", fp.URL))); !os.IsNotExist(err) {
+		t.Error(`Evicted entry left on disk.`)
+	}
+
+	cacheGet(t, c, fp, baseDir, "a")
+	if n := fp.count("a"); n != 1 {
+		t.Errorf(`a downloaded %d times.  Expected once.`, n)
+	}
+}
+
+func TestCacheOversized(t *testing.T) {
+	// a file larger than the whole cache is still delivered.
+	fp, c, baseDir, cleanup := cacheTest(t, 5, 0)
+	defer cleanup()
+	cacheGet(t, c, fp, baseDir, "a")
+	cacheGet(t, c, fp, baseDir, "b")
+}
+
+func TestCacheReload(t *testing.T) {
+	fp, c, baseDir, cleanup := cacheTest(t, 0, 0)
+	defer cleanup()
+	cacheGet(t, c, fp, baseDir, "a")
+
+	// leftover from an interrupted download
+	leftover := filepath.Join(c.Dir, ".dl-leftover")
+	if err := os.Mkdir(leftover, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	c2, err := NewCache(c.Dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheGet(t, c2, fp, baseDir, "a")
+	if n := fp.count("a"); n != 1 {
+		t.Errorf(`Downloaded %d times across restart.  Expected once.`, n)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Error(`Leftover download folder not removed.`)
+	}
+}
+
+func TestCacheAccessCheck(t *testing.T) {
+	fp, c, baseDir, cleanup := cacheTest(t, 0, 0)
+	defer cleanup()
+	cacheGet(t, c, fp, baseDir, "a")
+
+	_, _, err := c.DownloadSum("a", runDir(t, baseDir), fp.URL, "denied")
+	if err == nil {
+		t.Error(`Cached file delivered to a caller that Pz refuses.`)
+	}
+
+	_, _, meta, err := c.DownloadMeta("a", runDir(t, baseDir), fp.URL, "other")
+	if err != nil || meta == nil {
+		t.Errorf(`DownloadMeta for a new caller returned %v, %v.  Expected the metadata of its access check.`, meta, err)
+	}
+}
+
+func TestCacheWaiterRetries(t *testing.T) {
+	fp, c, baseDir, cleanup := cacheTest(t, 0, 0)
+	defer cleanup()
+
+	// the first caller's download fails, but only after the second has
+	// started waiting on it.
+	denied := make(chan error)
+	go func() {
+		_, _, err := c.DownloadSum("a", runDir(t, baseDir), fp.URL, "slow-denied")
+		denied <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cacheGet(t, c, fp, baseDir, "a")
+	if err := <-denied; err == nil {
+		t.Error(`Download with a refused auth key succeeded.`)
+	}
+	if n := fp.count("a"); n != 1 {
+		t.Errorf(`Downloaded %d times.  Expected once.`, n)
+	}
+}
+
+func TestCacheKeyedByPz(t *testing.T) {
+	fp, c, baseDir, cleanup := cacheTest(t, 0, 0)
+	defer cleanup()
+	fp2 := newFakePz()
+	defer fp2.Close()
+
+	// the same dataId from another Pz instance is a different file.
+	cacheGet(t, c, fp, baseDir, "a")
+	cacheGet(t, c, fp2, baseDir, "a")
+	if n, n2 := fp.count("a"), fp2.count("a"); n != 1 || n2 != 1 {
+		t.Errorf(`Downloaded %d and %d times.  Expected once from each.`, n, n2)
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pzsvc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// ExecResult is the reply of a pzsvc-exec service, as far as is needed to
+// chain further work onto it.  OutFiles maps output filenames to the dataIds
+// they were uploaded as.
+type ExecResult struct {
+	RunID      string            `json:"RunID,omitempty"`
+	InFiles    map[string]string `json:"InFiles,omitempty"`
+	OutFiles   map[string]string `json:"OutFiles,omitempty"`
+	ProgReturn string            `json:"ProgReturn,omitempty"`
+	Errors     []string          `json:"Errors,omitempty"`
+}
+
+// ParamInputs converts a set of request parameters into the data inputs of
+// a Pz execute call, passing each as a URL parameter.  This is the form that
+// pzsvc-exec services (and most other POST services) take their parameters in.
+func ParamInputs(params map[string]string) map[string]DataType {
+	inputs := make(map[string]DataType)
+	for key, val := range params {
+		inputs[key] = DataType{Content: val, Type: "urlparameter", MimeType: "text/plain"}
+	}
+	return inputs
+}
+
+// SubmitExec asks Pz to execute the given service with the given data
+// inputs, and returns the jobId of the resulting job.  If no outputs are
+// given, the service is expected to reply with text.
+func SubmitExec(svcID, pzAddr, authKey string, inputs map[string]DataType, outputs []DataType) (string, error) {
+	if outputs == nil {
+		outputs = []DataType{{Type: "text", MimeType: "application/json"}}
+	}
+	jobObj := ExecJobType{"execute-service", ExecServiceData{svcID, inputs, outputs}}
+	jobJSON, err := json.Marshal(jobObj)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := SubmitSinglePart("POST", string(jobJSON), pzAddr+"/job", authKey)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+	respBuf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf(`Execution of service %s failed with status "%s".  Response: %s`, svcID, resp.Status, string(respBuf))
+	}
+
+	var respObj JobResp
+	err = json.Unmarshal(respBuf, &respObj)
+	if err != nil {
+		return "", err
+	}
+	if respObj.JobID == "" {
+		return "", fmt.Errorf(`Execution of service %s returned no jobId.  Response: %s`, svcID, string(respBuf))
+	}
+	return respObj.JobID, nil
+}
+
+// WaitForJob polls the status of the given job until it finishes or the
+// timeout runs out, and returns the final status.  Jobs that end in anything
+// other than success are reported as errors.  Polling starts quickly and
+// slows down as the job runs on.
+func WaitForJob(jobID, pzAddr, authKey string, timeout time.Duration) (*JobResp, error) {
+	deadline := time.Now().Add(timeout)
+	delay := 300 * time.Millisecond
+	var lastBuf []byte
+	for {
+		time.Sleep(delay)
+		if delay < 5*time.Second {
+			delay *= 2
+		}
+
+		resp, err := submitGet(pzAddr+"/job/"+jobID, authKey)
+		if err != nil {
+			return nil, err
+		}
+		lastBuf, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		var respObj JobResp
+		err = json.Unmarshal(lastBuf, &respObj)
+		if err != nil {
+			return nil, err
+		}
+
+		switch respObj.Status {
+		case "Success":
+			return &respObj, nil
+		case "Submitted", "Pending", "Running", "Error":
+			// As in getDataID, "Error" is not always final.  Keep trying
+			// until the timeout.
+		default:
+			return nil, fmt.Errorf(`Job %s ended with status "%s".  Response json: %s`, jobID, respObj.Status, string(lastBuf))
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf(`Job %s did not complete within %s.  Last response json: %s`, jobID, timeout.String(), string(lastBuf))
+		}
+	}
+}
+
+// CallService executes the given service through Pz, waits for it to finish,
+// and returns the dataId of the result.
+func CallService(svcID, pzAddr, authKey string, inputs map[string]DataType, outputs []DataType, timeout time.Duration) (string, error) {
+	jobID, err := SubmitExec(svcID, pzAddr, authKey, inputs, outputs)
+	if err != nil {
+		return "", err
+	}
+	jobResp, err := WaitForJob(jobID, pzAddr, authKey, timeout)
+	if err != nil {
+		return "", err
+	}
+	if jobResp.Result.DataID == "" {
+		return "", fmt.Errorf(`Job %s succeeded, but returned no dataId.`, jobID)
+	}
+	return jobResp.Result.DataID, nil
+}
+
+// CallServiceByName is CallService, but for the service of the given name.
+func CallServiceByName(svcName, pzAddr, authKey string, inputs map[string]DataType, outputs []DataType, timeout time.Duration) (string, error) {
+	svcID, err := FindServiceByName(svcName, pzAddr, authKey)
+	if err != nil {
+		return "", err
+	}
+	return CallService(svcID, pzAddr, authKey, inputs, outputs, timeout)
+}
+
+// FindServiceByName looks up the service ID for a service name.  Unlike
+// FindOwnedSvc, it matches any user's service, and so fails if the name is
+// ambiguous.
+func FindServiceByName(svcName, pzAddr, authKey string) (string, error) {
+	matches, err := SearchServices(SearchQuery{Keyword: svcName}, pzAddr, authKey)
+	if err != nil {
+		return "", err
+	}
+
+	var svcID string
+	for _, checkServ := range matches {
+		if checkServ.ResMeta.Name != svcName {
+			continue
+		}
+		if svcID != "" && svcID != checkServ.ServiceID {
+			return "", fmt.Errorf(`More than one service is named "%s".  Use the service ID instead.`, svcName)
+		}
+		svcID = checkServ.ServiceID
+	}
+
+	if svcID == "" {
+		return "", fmt.Errorf(`No service named "%s" found.`, svcName)
+	}
+	return svcID, nil
+}
+
+// GetText retrieves the content of a text data resource, such as the result
+// of a service call.  Pz usually holds text inline in the resource's
+// metadata.  Where it does not, the file is downloaded instead.
+func GetText(dataID, pzAddr, authKey string) (string, error) {
+	dataRes, err := GetFileMeta(dataID, pzAddr, authKey)
+	if err != nil {
+		return "", err
+	}
+	if dataRes.DataType.Content != "" {
+		return dataRes.DataType.Content, nil
+	}
+	b, err := DownloadBytes(dataID, pzAddr, authKey)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// GetExecResult retrieves the result of a call to a pzsvc-exec service and
+// interprets it.  Errors reported by the service are returned as an error,
+// along with the result.
+func GetExecResult(dataID, pzAddr, authKey string) (*ExecResult, error) {
+	text, err := GetText(dataID, pzAddr, authKey)
+	if err != nil {
+		return nil, err
+	}
+	var result ExecResult
+	err = json.Unmarshal([]byte(text), &result)
+	if err != nil {
+		return nil, fmt.Errorf(`Result %s is not a pzsvc-exec reply: %s`, dataID, err.Error())
+	}
+	if len(result.Errors) != 0 {
+		return &result, fmt.Errorf(`Service reported errors: %v`, result.Errors)
+	}
+	return &result, nil
+}
+
+// DownloadResults downloads each of the given dataIds into the subfolder.
+// It takes a map of filenames to dataIds, such as ExecResult.OutFiles, and
+// returns the local filename of each download, under the same keys.
+func DownloadResults(files map[string]string, subFold, pzAddr, authKey string) (map[string]string, error) {
+	fNames := make(map[string]string)
+	for key, dataID := range files {
+		fName, err := Download(dataID, subFold, pzAddr, authKey)
+		if err != nil {
+			return fNames, err
+		}
+		fNames[key] = fName
+	}
+	return fNames, nil
+}
@@ -0,0 +1,299 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pzsvc
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fetchTimeout bounds the whole of a single retrieval, body included.
+const fetchTimeout = 30 * time.Minute
+
+// maxRedirects is the number of redirects a retrieval will follow.
+const maxRedirects = 10
+
+// Fetcher is the interface for anything capable of retrieving an input
+// file from some source and writing it into the given subfolder.  It
+// returns the name of the file as written, along with its checksum.
+type Fetcher interface {
+	Fetch(source, subFold string) (string, FileSum, error)
+}
+
+// MetaFetcher is a Fetcher that also provides the Pz metadata of the files
+// it retrieves, where it has them.  The metadata is nil otherwise.
+type MetaFetcher interface {
+	FetchMeta(source, subFold string) (string, FileSum, *DataResource, error)
+}
+
+// FetcherSet maps source schemes to the Fetcher that handles them.  Sources
+// with no scheme (no "://") are Piazza dataIds, and are keyed under "".
+type FetcherSet map[string]Fetcher
+
+// Fetch picks the appropriate Fetcher for the source and calls it.
+func (fs FetcherSet) Fetch(source, subFold string) (string, FileSum, error) {
+	scheme := SourceScheme(source)
+	fetcher, ok := fs[scheme]
+	if !ok || fetcher == nil {
+		if scheme == "" {
+			return "", FileSum{}, fmt.Errorf(`Cannot retrieve %s.  Piazza file download not enabled.`, source)
+		}
+		return "", FileSum{}, fmt.Errorf(`Cannot retrieve %s.  Scheme "%s" not supported or not enabled.`, source, scheme)
+	}
+	return fetcher.Fetch(source, subFold)
+}
+
+// FetchMeta is Fetch, but also returns the Pz metadata of the file where the
+// Fetcher used is a MetaFetcher and has it.
+func (fs FetcherSet) FetchMeta(source, subFold string) (string, FileSum, *DataResource, error) {
+	if metaFetcher, ok := fs[SourceScheme(source)].(MetaFetcher); ok {
+		return metaFetcher.FetchMeta(source, subFold)
+	}
+	fName, sum, err := fs.Fetch(source, subFold)
+	return fName, sum, nil, err
+}
+
+// SourceScheme returns the lowercased URL scheme of an input source, or
+// the empty string if the source is a Piazza dataId.
+func SourceScheme(source string) string {
+	i := strings.Index(source, "://")
+	if i <= 0 {
+		return ""
+	}
+	return strings.ToLower(source[:i])
+}
+
+// PzFetcher retrieves Piazza dataIds through Download, or through the
+// Cache if one is provided.
+type PzFetcher struct {
+	PzAddr  string
+	AuthKey string
+	Cache   *Cache
+}
+
+// Fetch implements Fetcher
+func (pf PzFetcher) Fetch(source, subFold string) (string, FileSum, error) {
+	fName, sum, _, err := pf.FetchMeta(source, subFold)
+	return fName, sum, err
+}
+
+// FetchMeta implements MetaFetcher
+func (pf PzFetcher) FetchMeta(source, subFold string) (string, FileSum, *DataResource, error) {
+	if pf.Cache != nil {
+		return pf.Cache.DownloadMeta(source, subFold, pf.PzAddr, pf.AuthKey)
+	}
+	return DownloadMeta(source, subFold, pf.PzAddr, pf.AuthKey)
+}
+
+// HTTPFetcher retrieves http and https URLs.  Only hosts on the AllowHosts
+// list may be contacted.  Entries starting with "." match any subdomain of
+// the given domain.
+type HTTPFetcher struct {
+	AllowHosts []string
+}
+
+// Fetch implements Fetcher
+func (hf HTTPFetcher) Fetch(source, subFold string) (string, FileSum, error) {
+	srcURL, err := url.Parse(source)
+	if err != nil {
+		return "", FileSum{}, err
+	}
+	if !hostAllowed(srcURL.Hostname(), hf.AllowHosts) {
+		return "", FileSum{}, fmt.Errorf(`Cannot retrieve %s.  Host "%s" is not on the allowed list.`, source, srcURL.Hostname())
+	}
+	client := fetchClient(func(host string) bool {
+		return hostAllowed(host, hf.AllowHosts)
+	})
+	return fetchURL(client, source, path.Base(srcURL.Path), subFold)
+}
+
+// FileFetcher copies file:// paths into the subfolder.  Only paths under
+// Root may be read.
+type FileFetcher struct {
+	Root string
+}
+
+// Fetch implements Fetcher
+func (ff FileFetcher) Fetch(source, subFold string) (string, FileSum, error) {
+	srcURL, err := url.Parse(source)
+	if err != nil {
+		return "", FileSum{}, err
+	}
+	if srcURL.Host != "" && srcURL.Host != "localhost" {
+		return "", FileSum{}, fmt.Errorf(`Cannot retrieve %s.  Remote file hosts not supported.`, source)
+	}
+
+	root, err := filepath.EvalSymlinks(ff.Root)
+	if err != nil {
+		return "", FileSum{}, err
+	}
+	srcPath, err := filepath.EvalSymlinks(filepath.Clean(srcURL.Path))
+	if err != nil {
+		return "", FileSum{}, err
+	}
+	rel, err := filepath.Rel(root, srcPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", FileSum{}, fmt.Errorf(`Cannot retrieve %s.  Path is outside of the permitted root.`, source)
+	}
+
+	fName, err := SafeName(filepath.Base(srcPath))
+	if err != nil {
+		return "", FileSum{}, err
+	}
+
+	in, err := os.Open(srcPath)
+	if err != nil {
+		return "", FileSum{}, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return "", FileSum{}, err
+	}
+
+	sum, err := writeFile(locString(subFold, fName), in, info.Size())
+	if err != nil {
+		return "", FileSum{}, err
+	}
+	return fName, sum, nil
+}
+
+// S3Fetcher retrieves s3://bucket/key URLs from an S3-compatible object
+// store, using path-style addressing against Endpoint.  Requests are not
+// signed, so objects must be readable without credentials.
+type S3Fetcher struct {
+	Endpoint string
+}
+
+// Fetch implements Fetcher
+func (sf S3Fetcher) Fetch(source, subFold string) (string, FileSum, error) {
+	srcURL, err := url.Parse(source)
+	if err != nil {
+		return "", FileSum{}, err
+	}
+	key := strings.TrimPrefix(srcURL.Path, "/")
+	if srcURL.Host == "" || key == "" {
+		return "", FileSum{}, fmt.Errorf(`Cannot retrieve %s.  S3 URLs must be of the form s3://bucket/key.`, source)
+	}
+	objURL := fmt.Sprintf(`%s/%s/%s`, strings.TrimSuffix(sf.Endpoint, "/"), srcURL.Host, key)
+	endpointURL, err := url.Parse(sf.Endpoint)
+	if err != nil {
+		return "", FileSum{}, err
+	}
+	client := fetchClient(func(host string) bool {
+		return strings.EqualFold(host, endpointURL.Hostname())
+	})
+	return fetchURL(client, objURL, path.Base(key), subFold)
+}
+
+// fetchClient returns an http.Client for retrievals.  Redirects are only
+// followed to hosts that pass the allowed check, so that a permitted host
+// cannot hand the request on to one that is not.
+func fetchClient(allowed func(host string) bool) *http.Client {
+	return &http.Client{
+		Timeout: fetchTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf(`Stopped after %d redirects.`, maxRedirects)
+			}
+			if !allowed(req.URL.Hostname()) {
+				return fmt.Errorf(`Redirect to host "%s" is not on the allowed list.`, req.URL.Hostname())
+			}
+			return nil
+		},
+	}
+}
+
+// fetchURL performs an unauthenticated GET on the given address through the
+// given client and writes the body into the subfolder.  The filename is taken
+// from Content-Disposition if present, and from defName otherwise.
+func fetchURL(client *http.Client, address, defName, subFold string) (string, FileSum, error) {
+	resp, err := client.Get(address)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return "", FileSum{}, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", FileSum{}, fmt.Errorf(`Retrieval of %s failed with status "%s".`, address, resp.Status)
+	}
+
+	filename := defName
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		filename = params["filename"]
+	}
+	filename, err = SafeName(filename)
+	if err != nil {
+		return "", FileSum{}, err
+	}
+
+	sum, err := writeFile(locString(subFold, filename), resp.Body, resp.ContentLength)
+	if err != nil {
+		return "", FileSum{}, fmt.Errorf(`Retrieval of %s failed: %s`, address, err.Error())
+	}
+	return filename, sum, nil
+}
+
+// writeFile copies the contents of the reader into a newly created file,
+// and verifies the result against the expected size (if nonnegative).  On
+// failure, the partial file is removed.
+func writeFile(fPath string, in io.Reader, expSize int64) (FileSum, error) {
+	out, err := os.Create(fPath)
+	if err != nil {
+		return FileSum{}, err
+	}
+	sum, err := CopySum(out, in)
+	if cErr := out.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = sum.Verify(expSize, fPath)
+	}
+	if err != nil {
+		os.Remove(fPath)
+		return FileSum{}, err
+	}
+	return sum, nil
+}
+
+// SafeName checks that a filename from an outside source is usable as a
+// plain filename within a run folder, stripping any directory components.
+func SafeName(fName string) (string, error) {
+	base := filepath.Base(strings.Replace(fName, `\`, "/", -1))
+	if base == "" || base == "." || base == ".." || base == "/" {
+		return "", fmt.Errorf(`Invalid filename "%s".`, fName)
+	}
+	return base, nil
+}
+
+func hostAllowed(host string, allowHosts []string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range allowHosts {
+		allowed = strings.ToLower(allowed)
+		if allowed == host || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return true
+		}
+	}
+	return false
+}
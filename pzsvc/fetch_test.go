@@ -0,0 +1,90 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pzsvc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestHostAllowed(t *testing.T) {
+	allow := []string{"data.example.com", ".trusted.org", "10.0.0.5"}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"data.example.com", true},
+		{"DATA.Example.COM", true},
+		{"other.example.com", false},
+		{"example.com", false},
+		{"data.example.com.evil.net", false},
+		{"a.trusted.org", true},
+		{"a.b.trusted.org", true},
+		{"trusted.org", false},
+		{"nottrusted.org", false},
+		{"trusted.org.evil.net", false},
+		{"10.0.0.5", true},
+		{"10.0.0.6", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := hostAllowed(test.host, allow); got != test.want {
+			t.Errorf(`hostAllowed(%q) = %v.  Expected %v.`, test.host, got, test.want)
+		}
+	}
+	if hostAllowed("data.example.com", nil) {
+		t.Error(`hostAllowed with an empty list allowed a host.`)
+	}
+}
+
+func TestHTTPFetcherRedirects(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "internal")
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	// target is reachable as both 127.0.0.1 and localhost, so redirecting
+	// from one name to the other changes host without changing server.
+	redir := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://localhost:"+targetURL.Port()+"/x.txt", http.StatusFound)
+	}))
+	defer redir.Close()
+
+	subFold, err := ioutil.TempDir("", "pzsvc-fetch-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(subFold)
+
+	_, _, err = HTTPFetcher{AllowHosts: []string{"127.0.0.1"}}.Fetch(redir.URL+"/a.txt", subFold)
+	if err == nil {
+		t.Error(`Fetch followed a redirect to a host not on the allowed list.`)
+	}
+
+	fName, _, err := HTTPFetcher{AllowHosts: []string{"127.0.0.1", "localhost"}}.Fetch(redir.URL+"/a.txt", subFold)
+	if err != nil {
+		t.Fatalf(`Fetch with both hosts allowed failed: %s`, err.Error())
+	}
+	content, _ := ioutil.ReadFile(locString(subFold, fName))
+	if string(content) != "internal" {
+		t.Errorf(`Fetch wrote %q.`, content)
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"mime/multipart"
 	"net/http"
 	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -32,6 +33,9 @@ func locString(subFold, fname string ) string {
 	if subFold == "" {
 		return fmt.Sprintf(`./%s`, fname)
 	}
+	if filepath.IsAbs(subFold) {
+		return filepath.Join(subFold, fname)
+	}
 	return fmt.Sprintf(`./%s/%s`, subFold, fname)	
 }
 
@@ -45,8 +49,7 @@ func submitGet(payload, authKey string) (*http.Response, error) {
 
 	fileReq.Header.Add("Authorization", authKey)
 
-	client := &http.Client{}
-	return client.Do(fileReq)
+	return doRequest(fileReq)
 }
 
 // submitMultipart sends a multi-part POST call, including an optional uploaded file,
@@ -89,8 +92,7 @@ func submitMultipart(bodyStr, address, filename, authKey string, fileData []byte
 	fileReq.Header.Add("Content-Type", writer.FormDataContentType())
 	fileReq.Header.Add("Authorization", authKey)
 
-	client := &http.Client{}
-	resp, err := client.Do(fileReq)
+	resp, err := doRequest(fileReq)
 	if err != nil {
 		return nil, err
 	}
@@ -119,13 +121,30 @@ func DownloadBytes(dataID, pzAddr, authKey string) ([]byte, error) {
 
 // Download retrieves a file from Pz using the file access API
 func Download(dataID, subFold, pzAddr, authKey string) (string, error) {
+	fName, _, err := DownloadSum(dataID, subFold, pzAddr, authKey)
+	return fName, err
+}
+
+// DownloadSum retrieves a file from Pz as per Download, and also returns its
+// size and checksum.  The size received is verified against both the
+// Content-Length of the response and the file size on record with Piazza,
+// where those are available.
+func DownloadSum(dataID, subFold, pzAddr, authKey string) (string, FileSum, error) {
+	fName, sum, _, err := DownloadMeta(dataID, subFold, pzAddr, authKey)
+	return fName, sum, err
+}
+
+// DownloadMeta retrieves a file from Pz as per DownloadSum, and also returns the
+// Pz metadata of the file, which DownloadSum retrieves anyway to check the size
+// against.  The metadata is nil where Pz did not provide it.
+func DownloadMeta(dataID, subFold, pzAddr, authKey string) (string, FileSum, *DataResource, error) {
 
 	resp, err := submitGet(pzAddr + "/file/" + dataID, authKey)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
 	if err != nil {
-		return "", err
+		return "", FileSum{}, nil, err
 	}
 
 	contDisp := resp.Header.Get("Content-Disposition")
@@ -135,18 +154,31 @@ func Download(dataID, subFold, pzAddr, authKey string) (string, error) {
 		b := make([]byte, 100)
 		resp.Body.Read(b)
 		
-		return "", fmt.Errorf(`File for DataID %s unnamed.  Probable ingest error.  Initial response characters: %s`, dataID, string(b))
+		return "", FileSum{}, nil, fmt.Errorf(`File for DataID %s unnamed.  Probable ingest error.  Initial response characters: %s`, dataID, string(b))
+	}
+	filename, err = SafeName(filename)
+	if err != nil {
+		return "", FileSum{}, nil, err
 	}
 	
-	out, err := os.Create(locString(subFold, filename))
+	fPath := locString(subFold, filename)
+	sum, err := writeFile(fPath, resp.Body, resp.ContentLength)
 	if err != nil {
-		return "", err
+		return "", FileSum{}, nil, fmt.Errorf(`Download of DataID %s failed: %s`, dataID, err.Error())
 	}
 
-	defer out.Close()
-	io.Copy(out, resp.Body)
+	// Piazza's record of the file size is a secondary check.  If it
+	// isn't available, we make do with Content-Length.
+	dataRes, err := GetFileMeta(dataID, pzAddr, authKey)
+	if err == nil && dataRes.DataType.Location != nil && dataRes.DataType.Location.FileSize > 0 {
+		err = sum.Verify(int64(dataRes.DataType.Location.FileSize), "DataID " + dataID)
+		if err != nil {
+			os.Remove(fPath)
+			return "", FileSum{}, nil, err
+		}
+	}
 
-	return filename, nil
+	return filename, sum, dataRes, nil
 }
 
 // getDataID will repeatedly poll the job status on the given job Id
@@ -193,19 +225,34 @@ if respObj.Status == "Error" {fmt.Println(respBuf.String())}
 	return "", fmt.Errorf("Never completed.  JobId: %s", jobID)
 }
 
-// Ingest ingests the given bytes to Pz.  
+// Ingest ingests the given bytes to Pz.  The file is marked UNCLASSIFIED.
+// For control over classification, name and description, use IngestMeta.
 func Ingest(fName, fType, pzAddr, sourceName, version, authKey string,
 			ingData []byte,
 			props map[string]string) (string, error) {
 
-	var fileData []byte
-	var resp *http.Response
-
 	desc := fmt.Sprintf("%s uploaded by %s.", fType, sourceName)
-	rMeta := ResMeta{fName, desc, ClassType{"UNCLASSIFIED"}, "POST", version, make(map[string]string)} //TODO: implement classification
+	rMeta := ResMeta{Name: fName, Description: desc, ClassType: ClassType{"UNCLASSIFIED"}, Method: "POST", Version: version, Metadata: make(map[string]string)}
 	for key, val := range props {
 		rMeta.Metadata[key] = val
 	}
+	return IngestMeta(fName, fType, pzAddr, authKey, ingData, rMeta)
+}
+
+// IngestMeta ingests the given bytes to Pz, using the given resource metadata
+// as-is, other than adding the size and checksum of the data to it.  fType is
+// "raster", "geojson" or "text".
+func IngestMeta(fName, fType, pzAddr, authKey string, ingData []byte, rMeta ResMeta) (string, error) {
+
+	var fileData []byte
+	var resp *http.Response
+
+	metaCopy := make(map[string]string)
+	for key, val := range rMeta.Metadata {
+		metaCopy[key] = val
+	}
+	rMeta.Metadata = metaCopy
+	SumBytes(ingData).AddTo(rMeta.Metadata)
 
 	dType := DataType{"", fType, "", nil}
 
@@ -267,6 +314,16 @@ func IngestFile(fName, subFold, fType, pzAddr, sourceName, version, authKey stri
 	return Ingest(fName, fType, pzAddr, sourceName, version, authKey, fData, props)
 }
 
+// IngestFileMeta ingests the given file, as per IngestMeta
+func IngestFileMeta(fName, subFold, fType, pzAddr, authKey string, rMeta ResMeta) (string, error) {
+
+	fData, err := ioutil.ReadFile(locString(subFold, fName))
+	if err != nil {
+		return "", err
+	}
+	return IngestMeta(fName, fType, pzAddr, authKey, fData, rMeta)
+}
+
 // GetFileMeta retrieves the metadata for a given dataID in the S3 bucket
 func GetFileMeta(dataID, pzAddr, authKey string) (*DataResource, error) {
 
@@ -284,6 +341,9 @@ func GetFileMeta(dataID, pzAddr, authKey string) (*DataResource, error) {
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf(`Metadata request for DataID %s failed with status "%s".  Response: %s`, dataID, resp.Status, respBuf.String())
+	}
 
 	var respObj IngJobType
 	err = json.Unmarshal(respBuf.Bytes(), &respObj)
@@ -304,8 +364,22 @@ func UpdateFileMeta(dataID, pzAddr, authKey string, newMeta map[string]string )
 		return err
 	}
 	
-	_, err = SubmitSinglePart("POST", string(jbuff), fmt.Sprintf(`%s/data/%s`, pzAddr, dataID), authKey)
-	return err
+	resp, err := SubmitSinglePart("POST", string(jbuff), fmt.Sprintf(`%s/data/%s`, pzAddr, dataID), authKey)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	respBuf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf(`Metadata update for DataID %s failed with status "%s".  Response: %s`, dataID, resp.Status, string(respBuf))
+	}
+	return nil
 }
 
 
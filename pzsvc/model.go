@@ -78,6 +78,9 @@ type ResMeta struct {
 	Method			string		`json:"method,omitempty"`
 	Version			string		`json:"version,omitempty"`
 	Metadata		map[string]string `json:"metadata,omitempty"`
+	Availability	string		`json:"availability,omitempty"`
+	CreatedBy		string		`json:"createdBy,omitempty"`
+	CreatedOn		string		`json:"createdOn,omitempty"`
 }
 
 // S3Loc corresponds with model/data/location/S3FileStore.java
@@ -132,6 +135,20 @@ type ExecService struct {
 	DataOutput		DataType			`json:"dataOutput,omitempty"`
 }
 
+// ExecServiceData is ExecService as ExecuteServiceData.java has it now, with
+// a list of outputs.  It is what execute jobs are submitted with.
+type ExecServiceData struct {
+	ServiceID		string				`json:"serviceId,omitempty"`
+	DataInputs		map[string]DataType	`json:"dataInputs,omitempty"`
+	DataOutput		[]DataType			`json:"dataOutput,omitempty"`
+}
+
+// ExecJobType corresponds to model/job/type/ExecuteServiceJob.java
+type ExecJobType struct {
+	Type			string			`json:"type,omitempty"`
+	Data			ExecServiceData	`json:"data,omitempty"`
+}
+
 // Service corresponds to model/service/metadata/Service.java
 // Used as the payload in register service and update service jobs.
 // Also used in the response to the List Service job.
@@ -171,10 +188,27 @@ type JobResp struct { //name
 	Message			string		`json:"message,omitempty"`	//used for error responses
 }
 
+// SvcResp is the Pz response wrapper around a single service object.  It's
+// the response object for a get service call.  The ServiceID field is used
+// instead in the response to a register service call.
+type SvcResp struct {
+	Type		string		`json:"type,omitempty"`
+	ServiceID	string		`json:"serviceId,omitempty"`
+	Data		Service		`json:"data,omitempty"`
+}
+
 // SvcWrapper is the Pz generic list wrapper, around a list of service objects.
 // It's the response object for a list/search services call
 type SvcWrapper struct {
 	Type       string			`json:"type,omitempty"`
 	Data       []Service		`json:"data,omitempty"`
 	Pagination map[string]int	`json:"pagination,omitempty"`
-}
\ No newline at end of file
+}
+
+// DataWrapper is the Pz generic list wrapper, around a list of data resources.
+// It's the response object for a list/search data call
+type DataWrapper struct {
+	Type       string			`json:"type,omitempty"`
+	Data       []DataResource	`json:"data,omitempty"`
+	Pagination map[string]int	`json:"pagination,omitempty"`
+}
@@ -0,0 +1,72 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pzsvc
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CallInfo describes a single completed call to Pz.  Endpoint is the path
+// called, with IDs replaced by "{id}" (for example, "/data/{id}"), so that
+// calls can be grouped.  Status is zero if no response was received, in which
+// case Err is set.
+type CallInfo struct {
+	Method   string
+	Endpoint string
+	Status   int
+	Duration time.Duration
+	Err      error
+}
+
+var callObserver func(CallInfo)
+
+// SetCallObserver arranges for the given function to be called after every
+// call this package makes to Pz, for monitoring purposes.  It should be set
+// before any calls are made, and must be safe for concurrent use.
+func SetCallObserver(observer func(CallInfo)) {
+	callObserver = observer
+}
+
+// doRequest sends a request to Pz, and reports it to the observer, if any.
+func doRequest(req *http.Request) (*http.Response, error) {
+	client := &http.Client{}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if callObserver != nil {
+		info := CallInfo{Method: req.Method, Endpoint: endpointName(req.URL.Path), Duration: time.Since(start), Err: err}
+		if resp != nil {
+			info.Status = resp.StatusCode
+		}
+		callObserver(info)
+	}
+	return resp, err
+}
+
+// pzPathWords are the path segments of Pz endpoints that are not IDs.
+var pzPathWords = map[string]bool{
+	"data": true, "file": true, "job": true, "service": true, "query": true,
+	"trigger": true, "eventType": true, "event": true, "key": true, "v2": true}
+
+func endpointName(path string) string {
+	segs := strings.Split(strings.Trim(path, "/"), "/")
+	for i, seg := range segs {
+		if seg != "" && !pzPathWords[seg] {
+			segs[i] = "{id}"
+		}
+	}
+	return "/" + strings.Join(segs, "/")
+}
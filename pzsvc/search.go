@@ -0,0 +1,223 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pzsvc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SearchQuery describes a search for services or data resources.  Keyword
+// and CreatedBy are passed on to Pz.  The remaining filters are applied to
+// the results as they come back, so a Keyword or CreatedBy to narrow things
+// down first is a good idea on a busy Pz instance.  With CreatedAfter, the
+// listing is requested newest first, and reading stops at the first older
+// resource, so that only the recent pages are read.  Resources without a
+// readable createdOn pass CreatedAfter but not CreatedBefore.  Zero values
+// match everything.
+type SearchQuery struct {
+	Keyword       string
+	CreatedBy     string
+	Metadata      map[string]string // exact matches on resource metadata entries
+	BBox          *BBox             // data resources only.  Matches overlapping data.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	PerPage       int // page size to request from Pz.  Defaults to 100.
+	MaxResults    int // stop after this many matches.  Zero for no limit.
+}
+
+// BBox is a spatial bounding box, in the coordinates of the data searched.
+type BBox struct {
+	MinX float64
+	MinY float64
+	MaxX float64
+	MaxY float64
+}
+
+// maxPages bounds the number of pages any listing will read.
+const maxPages = 1000
+
+// SearchServices returns the services registered in Pz that match the
+// query, reading through as many pages as it takes.
+func SearchServices(query SearchQuery, pzAddr, authKey string) ([]Service, error) {
+	var results []Service
+	err := listServices(query.address(pzAddr+"/service"), authKey, func(svc Service) bool {
+		if query.olderThanWanted(svc.ResMeta) {
+			return true
+		}
+		if query.matches(svc.ResMeta, nil) {
+			results = append(results, svc)
+		}
+		return query.MaxResults > 0 && len(results) >= query.MaxResults
+	})
+	return results, err
+}
+
+// SearchData returns the data resources in Pz that match the query, reading
+// through as many pages as it takes.
+func SearchData(query SearchQuery, pzAddr, authKey string) ([]DataResource, error) {
+	var results []DataResource
+	err := listData(query.address(pzAddr+"/data"), authKey, func(dataRes DataResource) bool {
+		if query.olderThanWanted(dataRes.Metadata) {
+			return true
+		}
+		if query.matches(dataRes.Metadata, dataRes.SpatMeta) {
+			results = append(results, dataRes)
+		}
+		return query.MaxResults > 0 && len(results) >= query.MaxResults
+	})
+	return results, err
+}
+
+// address builds the Pz listing call for the query, less the page number.
+func (query SearchQuery) address(base string) string {
+	perPage := query.PerPage
+	if perPage <= 0 {
+		perPage = 100
+	}
+	params := url.Values{}
+	params.Set("per_page", strconv.Itoa(perPage))
+	if query.Keyword != "" {
+		params.Set("keyword", query.Keyword)
+	}
+	if query.CreatedBy != "" {
+		params.Set("userName", query.CreatedBy)
+	}
+	if !query.CreatedAfter.IsZero() {
+		params.Set("sortBy", "createdOn")
+		params.Set("order", "desc")
+	}
+	return base + "?" + params.Encode()
+}
+
+// olderThanWanted reports whether a resource in a newest-first listing was
+// created before CreatedAfter, in which case so is everything after it.
+func (query SearchQuery) olderThanWanted(meta ResMeta) bool {
+	if query.CreatedAfter.IsZero() {
+		return false
+	}
+	created, err := time.Parse(time.RFC3339, meta.CreatedOn)
+	return err == nil && created.Before(query.CreatedAfter)
+}
+
+// matches applies the filters that Pz does not apply for us.
+func (query SearchQuery) matches(meta ResMeta, spatMeta *SpatMeta) bool {
+	if query.CreatedBy != "" && meta.CreatedBy != query.CreatedBy {
+		return false
+	}
+	for key, val := range query.Metadata {
+		if mVal, ok := meta.Metadata[key]; !ok || mVal != val {
+			return false
+		}
+	}
+	if !query.CreatedAfter.IsZero() || !query.CreatedBefore.IsZero() {
+		created, err := time.Parse(time.RFC3339, meta.CreatedOn)
+		if err != nil {
+			// a resource without a readable createdOn may well be new,
+			// and is better listed again than missed.  Only CreatedBefore
+			// rules it out.
+			if !query.CreatedBefore.IsZero() {
+				return false
+			}
+		} else {
+			if !query.CreatedAfter.IsZero() && created.Before(query.CreatedAfter) {
+				return false
+			}
+			if !query.CreatedBefore.IsZero() && created.After(query.CreatedBefore) {
+				return false
+			}
+		}
+	}
+	if query.BBox != nil {
+		if spatMeta == nil {
+			return false
+		}
+		box := query.BBox
+		if spatMeta.MaxX < box.MinX || spatMeta.MinX > box.MaxX || spatMeta.MaxY < box.MinY || spatMeta.MinY > box.MaxY {
+			return false
+		}
+	}
+	return true
+}
+
+// listServices calls visit on each service in a Pz service listing, until
+// visit returns true or the listing runs out.
+func listServices(address, authKey string, visit func(Service) bool) error {
+	return listPages(address, authKey, func(respBuf []byte) (int, map[string]int, bool, error) {
+		var respObj SvcWrapper
+		err := json.Unmarshal(respBuf, &respObj)
+		if err != nil {
+			return 0, nil, false, err
+		}
+		for _, svc := range respObj.Data {
+			if visit(svc) {
+				return len(respObj.Data), respObj.Pagination, true, nil
+			}
+		}
+		return len(respObj.Data), respObj.Pagination, false, nil
+	})
+}
+
+// listData calls visit on each data resource in a Pz data listing, until
+// visit returns true or the listing runs out.
+func listData(address, authKey string, visit func(DataResource) bool) error {
+	return listPages(address, authKey, func(respBuf []byte) (int, map[string]int, bool, error) {
+		var respObj DataWrapper
+		err := json.Unmarshal(respBuf, &respObj)
+		if err != nil {
+			return 0, nil, false, err
+		}
+		for _, dataRes := range respObj.Data {
+			if visit(dataRes) {
+				return len(respObj.Data), respObj.Pagination, true, nil
+			}
+		}
+		return len(respObj.Data), respObj.Pagination, false, nil
+	})
+}
+
+// listPages requests each page of a Pz listing in turn, and hands it to
+// readPage, which reports the number of entries on the page, the pagination
+// block, and whether it has seen enough.
+func listPages(address, authKey string, readPage func([]byte) (int, map[string]int, bool, error)) error {
+	for page := 0; page < maxPages; page++ {
+		resp, err := submitGet(address+"&page="+strconv.Itoa(page), authKey)
+		if err != nil {
+			return err
+		}
+		respBuf, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf(`Listing failed with status "%s".  Response: %s`, resp.Status, string(respBuf))
+		}
+
+		count, pagination, done, err := readPage(respBuf)
+		if err != nil || done {
+			return err
+		}
+		perPage := pagination["per_page"]
+		if count == 0 || perPage <= 0 || (page+1)*perPage >= pagination["count"] {
+			return nil
+		}
+	}
+	return nil
+}
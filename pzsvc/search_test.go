@@ -0,0 +1,46 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pzsvc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchesCreatedOn(t *testing.T) {
+	bound := time.Date(2016, 9, 1, 12, 0, 0, 0, time.UTC)
+	after := SearchQuery{CreatedAfter: bound}
+	before := SearchQuery{CreatedBefore: bound}
+	tests := []struct {
+		desc      string
+		query     SearchQuery
+		createdOn string
+		want      bool
+	}{
+		{"after, newer", after, "2016-09-01T12:30:00.123Z", true},
+		{"after, older", after, "2016-09-01T11:30:00Z", false},
+		{"after, missing", after, "", true},
+		{"after, unparseable", after, "Thu Sep 1 12:30:00 2016", true},
+		{"before, older", before, "2016-09-01T11:30:00Z", true},
+		{"before, newer", before, "2016-09-01T12:30:00Z", false},
+		{"before, missing", before, "", false},
+		{"no bounds, missing", SearchQuery{}, "", true},
+	}
+	for _, test := range tests {
+		if got := test.query.matches(ResMeta{CreatedOn: test.createdOn}, nil); got != test.want {
+			t.Errorf(`%s: matches returned %v.  Expected %v.`, test.desc, got, test.want)
+		}
+	}
+}
@@ -16,44 +16,115 @@ package pzsvc
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 )
 
+// SvcOwner identifies the Pz service registration belonging to a particular
+// service instance.  User and InstanceID are optional, but without them, the
+// match is only as good as name and URL.
+type SvcOwner struct {
+	Name		string
+	URL			string
+	User		string	// the Pz user the service was registered under
+	InstanceID	string	// stored in the service metadata under InstanceKey
+}
+
+// InstanceKey is the service metadata key under which the instance ID of the
+// registering service instance is kept.
+const InstanceKey = "pzsvcInstanceId"
+
 // FindMySvc Searches Pz for a service matching the input information.  If it finds
-// one, it returns the service ID.  If it does not, returns an empty string.  Currently
-// only able to search on service name.  Will be much more viable as a long-term answer
-// if/when it's able to search on both service name and submitting user.
+// one, it returns the service ID.  If it does not, returns an empty string.  Only
+// able to search on service name, and so will match anyone's service of that name.
+// Use FindOwnedSvc where the rest of the owner information is known.
 func FindMySvc(svcName, pzAddr, authKey string) (string, error) {
 
-	query := pzAddr + "/service?per_page=1000&keyword=" + url.QueryEscape(svcName)
-	
-	resp, err := submitGet(query, authKey)
+	query := SearchQuery{Keyword: svcName}
+
+	var svcID string
+	err := listServices(query.address(pzAddr + "/service"), authKey, func(checkServ Service) bool {
+		if checkServ.ResMeta.Name == svcName {
+			svcID = checkServ.ServiceID
+			return true
+		}
+		return false
+	})
+	return svcID, err
+}
+
+// FindOwnedSvc Searches Pz for the service registered by the given owner.  If it
+// finds one, it returns the service ID.  If it does not, returns an empty string.
+// A service matches if it has the same name and URL, was registered by
+// owner.User (if given), and carries the same instance ID in its metadata.
+// Records without createdBy are accepted in place of owner.User where that
+// instance ID is nonempty.
+// Failing that, where owner.User is given, a service with the same name, URL
+// and user but no instance ID at all is taken as ours, from before instance IDs
+// were recorded.  Services registered by anyone else are never matched.
+func FindOwnedSvc(owner SvcOwner, pzAddr, authKey string) (string, error) {
+
+	query := SearchQuery{Keyword: owner.Name, CreatedBy: owner.User}
+
+	var svcID, adoptID string
+	err := listServices(query.address(pzAddr + "/service"), authKey, func(checkServ Service) bool {
+		meta := checkServ.ResMeta
+		if meta.Name != owner.Name || checkServ.URL != owner.URL {
+			return false
+		}
+		instID := meta.Metadata[InstanceKey]
+		exactInst := owner.InstanceID != "" && instID == owner.InstanceID
+		// Pz may leave createdBy out of listings.  An exact instance ID
+		// match is enough to go on without it.
+		if owner.User != "" && meta.CreatedBy != owner.User && !(meta.CreatedBy == "" && exactInst) {
+			return false
+		}
+		if instID == owner.InstanceID {
+			svcID = checkServ.ServiceID
+			return true
+		}
+		// without a user to go on, a record lacking an instance ID could
+		// be anyone's.
+		if instID == "" && owner.User != "" && adoptID == "" {
+			adoptID = checkServ.ServiceID
+		}
+		return false
+	})
 	if err != nil {
 		return "", err
 	}
 
-	respBuf, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+	if svcID == "" {
+		svcID = adoptID
 	}
+	return svcID, nil
+}
 
-	var respObj SvcWrapper
-	err = json.Unmarshal(respBuf, &respObj)
+// CheckPz confirms that Pz is reachable at the given address, and that it
+// accepts the given auth key.  It gives up once ctx is done.
+func CheckPz(ctx context.Context, pzAddr, authKey string) error {
+	checkReq, err := http.NewRequest("GET", pzAddr + "/service?per_page=1", nil)
 	if err != nil {
-		return "", err
+		return err
 	}
-
-	for _, checkServ := range respObj.Data {
-		if checkServ.ResMeta.Name == svcName {
-			return checkServ.ServiceID, nil
-		}
+	checkReq.Header.Add("Authorization", authKey)
+	resp, err := doRequest(checkReq.WithContext(ctx))
+	if resp != nil {
+		defer resp.Body.Close()
 	}
-
-	return "", nil
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf(`Pz rejected the auth key with status "%s".`, resp.Status)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf(`Pz replied with status "%s".`, resp.Status)
+	}
+	return nil
 }
 
 // SubmitSinglePart sends a single-part POST or a PUT call to Pz and returns the
@@ -74,8 +145,7 @@ func SubmitSinglePart(method, bodyStr, address, authKey string) (*http.Response,
 	fileReq.Header.Add("order", "true")
 	fileReq.Header.Add("Authorization", authKey)
 
-	client := &http.Client{}
-	resp, err := client.Do(fileReq)
+	resp, err := doRequest(fileReq)
 	if err != nil {
 		return nil, err
 	}
@@ -88,32 +158,212 @@ func SubmitSinglePart(method, bodyStr, address, authKey string) (*http.Response,
 // initial registration.  If it has not, it re-registers.  Best practice is to do this
 // every time your service starts up.  For those of you code-reading, the filter is
 // still somewhat rudimentary.  It will improve as better tools become available.
+// Use RegisterService for the service ID, or to identify the service more closely.
 func ManageRegistration(svcName, svcDesc, svcURL, pzAddr, svcVers, authKey string, attributes map[string]string) error {
-	
-	fmt.Println("Finding")
-	svcID, err := FindMySvc(svcName, pzAddr, authKey)
-	if err != nil {
-		return err
+	_, err := RegisterService(SvcOwner{Name: svcName, URL: svcURL}, svcDesc, pzAddr, svcVers, authKey, attributes)
+	return err
+}
+
+// RegisterService is ManageRegistration for the service of the given owner, as
+// found by FindOwnedSvc.  Returns the service ID, for use with DeregisterService.
+func RegisterService(owner SvcOwner, svcDesc, pzAddr, svcVers, authKey string, attributes map[string]string) (string, error) {
+	svcID, _, err := syncReg(owner, "", svcDesc, pzAddr, svcVers, authKey, attributes, true)
+	return svcID, err
+}
+
+// Results of SyncRegistration
+const (
+	RegCreated = "registered"
+	RegUpdated = "updated"
+	RegUnchanged = "unchanged"
+)
+
+// SyncRegistration is RegisterService for periodic use.  Where the service is
+// already registered, it compares the record in Pz with what would be registered,
+// and only updates it if they differ.  svcID is the service ID returned by the
+// previous call, if any.  It is used as-is unless Pz no longer has it, so that
+// the service is only searched for when its ID is unknown.  Returns the service
+// ID and which of RegCreated, RegUpdated or RegUnchanged applied.
+func SyncRegistration(owner SvcOwner, svcID, svcDesc, pzAddr, svcVers, authKey string, attributes map[string]string) (string, string, error) {
+	return syncReg(owner, svcID, svcDesc, pzAddr, svcVers, authKey, attributes, false)
+}
+
+func syncReg(owner SvcOwner, svcID, svcDesc, pzAddr, svcVers, authKey string, attributes map[string]string, force bool) (string, string, error) {
+
+	var current *Service
+	var err error
+	if svcID != "" {
+		var status int
+		current, status, err = getService(svcID, pzAddr, authKey)
+		if status == http.StatusNotFound {
+			svcID = ""
+		} else if err != nil {
+			return "", "", err
+		}
+	}
+	if svcID == "" {
+		svcID, err = FindOwnedSvc(owner, pzAddr, authKey)
+		if err != nil {
+			return "", "", err
+		}
+		if svcID != "" && !force {
+			current, _, err = getService(svcID, pzAddr, authKey)
+			if err != nil {
+				return "", "", err
+			}
+		}
 	}
 
 	svcClass := ClassType{"UNCLASSIFIED"} // TODO: this will have to be updated at some point.
-	metaObj := ResMeta{ svcName, svcDesc, svcClass, "POST", svcVers, make(map[string]string) }
+	metaObj := ResMeta{ Name: owner.Name, Description: svcDesc, ClassType: svcClass, Method: "POST",
+						Version: svcVers, Metadata: make(map[string]string), Availability: SvcOnline }
 	for key, val := range attributes {
 		metaObj.Metadata[key] = val
 	}
-	svcObj := Service{ svcID, svcURL, metaObj }
+	if owner.InstanceID != "" {
+		metaObj.Metadata[InstanceKey] = owner.InstanceID
+	}
+	svcObj := Service{ svcID, owner.URL, metaObj }
+
+	if current != nil && !force && SvcMatches(*current, svcObj) {
+		return svcID, RegUnchanged, nil
+	}
+
 	svcJSON, err := json.Marshal(svcObj)
+	if err != nil {
+		return "", "", err
+	}
 
+	var resp *http.Response
+	action := RegCreated
 	if svcID == "" {
 		fmt.Println("Registering")
-		_, err = SubmitSinglePart("POST", string(svcJSON), pzAddr+"/service", authKey)
+		resp, err = SubmitSinglePart("POST", string(svcJSON), pzAddr+"/service", authKey)
 	} else {
 		fmt.Println("Updating")
-		_, err = SubmitSinglePart("PUT", string(svcJSON), pzAddr+"/service/"+svcID, authKey)
+		action = RegUpdated
+		resp, err = SubmitSinglePart("PUT", string(svcJSON), pzAddr+"/service/"+svcID, authKey)
 	}
+	respObj, err := readSvcResp(resp, err, "Registration of "+owner.Name)
 	if err != nil {
+		return "", "", err
+	}
+
+	if svcID == "" {
+		svcID = respObj.ServiceID
+		if svcID == "" {
+			svcID = respObj.Data.ServiceID
+		}
+	}
+	return svcID, action, nil
+}
+
+// GetService retrieves the record for the given service ID from Pz.
+func GetService(svcID, pzAddr, authKey string) (*Service, error) {
+	svc, _, err := getService(svcID, pzAddr, authKey)
+	return svc, err
+}
+
+// getService is GetService, but also returns the response status, or zero
+// if there was no response.
+func getService(svcID, pzAddr, authKey string) (*Service, int, error) {
+	resp, err := submitGet(pzAddr+"/service/"+svcID, authKey)
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	respObj, err := readSvcResp(resp, err, "Retrieval of service "+svcID)
+	if err != nil {
+		return nil, status, err
+	}
+	return &respObj.Data, status, nil
+}
+
+// SvcMatches reports whether two service records agree on everything that
+// ManageRegistration sets: URL, name, description, classification, method,
+// version, availability and metadata.  Service IDs are not compared.
+func SvcMatches(have, want Service) bool {
+	hMeta, wMeta := have.ResMeta, want.ResMeta
+	if have.URL != want.URL || hMeta.Name != wMeta.Name || hMeta.Description != wMeta.Description ||
+		hMeta.ClassType != wMeta.ClassType || hMeta.Method != wMeta.Method ||
+		hMeta.Version != wMeta.Version || hMeta.Availability != wMeta.Availability {
+		return false
+	}
+	if len(hMeta.Metadata) != len(wMeta.Metadata) {
+		return false
+	}
+	for key, val := range wMeta.Metadata {
+		if hVal, ok := hMeta.Metadata[key]; !ok || hVal != val {
+			return false
+		}
+	}
+	return true
+}
+
+// Availability values for registered services.  Piazza passes the field
+// through without interpreting it.
+const (
+	SvcOnline = "ONLINE"
+	SvcOffline = "OFFLINE"
+)
+
+// DeregisterService takes a registered service out of use.  If remove is true,
+// the service is deleted from Pz outright.  Otherwise, it is left in place and
+// marked as offline, so that its service ID remains valid for when it comes
+// back up and re-registers through RegisterService.
+func DeregisterService(svcID, pzAddr, authKey string, remove bool) error {
+
+	if svcID == "" {
+		return fmt.Errorf("Cannot deregister service.  No service ID.")
+	}
+
+	if remove {
+		resp, err := SubmitSinglePart("DELETE", "", pzAddr+"/service/"+svcID, authKey)
+		_, err = readSvcResp(resp, err, "Deletion of service "+svcID)
 		return err
 	}
 
-	return nil
+	current, err := GetService(svcID, pzAddr, authKey)
+	if err != nil {
+		return err
+	}
+
+	svcObj := *current
+	svcObj.ServiceID = svcID
+	svcObj.ResMeta.Availability = SvcOffline
+	svcJSON, err := json.Marshal(svcObj)
+	if err != nil {
+		return err
+	}
+	resp, err := SubmitSinglePart("PUT", string(svcJSON), pzAddr+"/service/"+svcID, authKey)
+	_, err = readSvcResp(resp, err, "Update of service "+svcID)
+	return err
+}
+
+// readSvcResp checks the response to a service call for failure, and
+// interprets the body, if any, as a SvcResp.
+func readSvcResp(resp *http.Response, err error, desc string) (*SvcResp, error) {
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	respBuf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf(`%s failed with status "%s".  Response: %s`, desc, resp.Status, string(respBuf))
+	}
+
+	var respObj SvcResp
+	if len(bytes.TrimSpace(respBuf)) != 0 {
+		err = json.Unmarshal(respBuf, &respObj)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &respObj, nil
 }
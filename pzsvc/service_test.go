@@ -0,0 +1,60 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pzsvc
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFindOwnedSvc(t *testing.T) {
+	svc := func(id, user, instID string) Service {
+		meta := ResMeta{Name: "svc", CreatedBy: user}
+		if instID != "" {
+			meta.Metadata = map[string]string{InstanceKey: instID}
+		}
+		return Service{ServiceID: id, URL: "http://svc", ResMeta: meta}
+	}
+	owner := SvcOwner{Name: "svc", URL: "http://svc", User: "alice", InstanceID: "inst1"}
+	tests := []struct {
+		desc    string
+		listing []Service
+		want    string
+	}{
+		{"exact match", []Service{svc("s1", "alice", "inst1")}, "s1"},
+		{"no createdBy, same instance", []Service{svc("s1", "", "inst1")}, "s1"},
+		{"no createdBy, other instance", []Service{svc("s1", "", "inst2")}, ""},
+		{"no createdBy, no instance", []Service{svc("s1", "", "")}, ""},
+		{"other user, same instance", []Service{svc("s1", "bob", "inst1")}, ""},
+		{"adopted", []Service{svc("s1", "alice", "")}, "s1"},
+		{"exact preferred", []Service{svc("s1", "alice", ""), svc("s2", "alice", "inst1")}, "s2"},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(SvcWrapper{Type: "service-list", Data: test.listing})
+		}))
+		got, err := FindOwnedSvc(owner, server.URL, "key")
+		server.Close()
+		if err != nil {
+			t.Errorf(`%s: FindOwnedSvc failed: %s`, test.desc, err.Error())
+			continue
+		}
+		if got != test.want {
+			t.Errorf(`%s: FindOwnedSvc returned %q.  Expected %q.`, test.desc, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pzsvc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// FileSum records the size and SHA-256 digest of a file.
+type FileSum struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Verify checks the size against an expected value.  Negative expected
+// sizes indicate that the size is not known, and always pass.
+func (fs FileSum) Verify(expSize int64, desc string) error {
+	if expSize >= 0 && fs.Size != expSize {
+		return fmt.Errorf(`Size mismatch on %s: expected %d bytes, received %d.  File may be truncated.`, desc, expSize, fs.Size)
+	}
+	return nil
+}
+
+// AddTo records the checksum in a metadata map, in the form used for
+// ingested files.
+func (fs FileSum) AddTo(meta map[string]string) {
+	meta["fileSize"] = strconv.FormatInt(fs.Size, 10)
+	meta["sha256"] = fs.SHA256
+}
+
+// SumBytes computes the FileSum of a byte slice.
+func SumBytes(b []byte) FileSum {
+	sum := sha256.Sum256(b)
+	return FileSum{int64(len(b)), hex.EncodeToString(sum[:])}
+}
+
+// SumFile computes the FileSum of the file at the given path.
+func SumFile(fPath string) (FileSum, error) {
+	in, err := os.Open(fPath)
+	if err != nil {
+		return FileSum{}, err
+	}
+	defer in.Close()
+	return CopySum(ioutil.Discard, in)
+}
+
+// CopySum copies from the reader to the writer, computing the FileSum of
+// everything copied.  Copy errors are returned, so that interrupted
+// transfers do not pass for complete ones.
+func CopySum(out io.Writer, in io.Reader) (FileSum, error) {
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, hash), in)
+	if err != nil {
+		return FileSum{}, err
+	}
+	return FileSum{size, hex.EncodeToString(hash.Sum(nil))}, nil
+}
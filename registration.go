@@ -0,0 +1,149 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pzsvc-exec/pzsvc"
+)
+
+// registrar keeps the Piazza registration of this service in line with the
+// config.  It checks the registration at startup and then every interval,
+// registering or updating the service whenever the record in Piazza has gone
+// missing or drifted.
+type registrar struct {
+	configObj	configType
+	svcURL		string
+	version		string
+	authKey		string
+	attributes	map[string]string
+	interval	time.Duration
+	stop		chan struct{}
+	done		chan struct{}
+
+	mu			sync.Mutex
+	status		regStatus
+}
+
+// regStatus is the response to the /registration endpoint.
+type regStatus struct {
+	Enabled		bool	`json:"enabled"`
+	ServiceID	string	`json:"serviceId,omitempty"`
+	LastAction	string	`json:"lastAction,omitempty"`
+	LastAttempt	string	`json:"lastAttempt,omitempty"`
+	LastSuccess	string	`json:"lastSuccess,omitempty"`
+	LastChange	string	`json:"lastChange,omitempty"`
+	LastError	string	`json:"lastError,omitempty"`
+	IntervalMins	int		`json:"intervalMins,omitempty"`
+}
+
+func newRegistrar(configObj configType, svcURL, version, authKey string, attributes map[string]string) *registrar {
+	return &registrar{	configObj: configObj,
+						svcURL: svcURL,
+						version: version,
+						authKey: authKey,
+						attributes: attributes,
+						interval: time.Duration(configObj.RegCheckMins) * time.Minute,
+						stop: make(chan struct{}),
+						done: make(chan struct{}),
+						status: regStatus{Enabled: true, IntervalMins: configObj.RegCheckMins} }
+}
+
+// sync performs a single check of the registration, and records the result.
+func (reg *registrar) sync() {
+	owner := pzsvc.SvcOwner{	Name: reg.configObj.SvcName,
+								URL: reg.svcURL,
+								User: reg.configObj.PzUser,
+								InstanceID: reg.configObj.InstanceID }
+	svcID, action, err := pzsvc.SyncRegistration(	owner,
+													reg.serviceID(),
+													reg.configObj.Description,
+													reg.configObj.PzAddr,
+													reg.version,
+													reg.authKey,
+													reg.attributes )
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.status.LastAttempt = now
+	if err != nil {
+		fmt.Println("error: registration check failed: " + err.Error())
+		reg.status.LastError = err.Error()
+		return
+	}
+	if action != pzsvc.RegUnchanged {
+		fmt.Println("Service " + action + " as " + svcID + ".")
+		reg.status.LastChange = now
+	}
+	reg.status.ServiceID = svcID
+	reg.status.LastAction = action
+	reg.status.LastSuccess = now
+	reg.status.LastError = ""
+}
+
+// run calls sync every interval until halt is called.
+func (reg *registrar) run() {
+	defer close(reg.done)
+	ticker := time.NewTicker(reg.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-reg.stop:
+			return
+		case <-ticker.C:
+			reg.sync()
+		}
+	}
+}
+
+// halt stops the run loop, waiting for any check in progress to finish, so
+// that the registration is not restored after deregistration.
+func (reg *registrar) halt() {
+	close(reg.stop)
+	<-reg.done
+}
+
+func (reg *registrar) serviceID() string {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.status.ServiceID
+}
+
+// handleRegistration serves the /registration endpoint, reporting the
+// outcome of the latest registration checks.
+func handleRegistration(w http.ResponseWriter, reg *registrar) {
+	if reg == nil {
+		printJSON(w, regStatus{})
+		return
+	}
+	reg.mu.Lock()
+	status := reg.status
+	reg.mu.Unlock()
+	printJSON(w, status)
+}
+
+// defaultInstanceID derives an instance ID from the Piazza address, service
+// name and URL, so that it is stable across restarts without being stored.
+func defaultInstanceID(configObj configType) string {
+	sum := sha256.Sum256([]byte(configObj.PzAddr + "\n" + configObj.SvcName + "\n" + configObj.URL))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,216 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/venicegeo/pzsvc-exec/pzsvc"
+)
+
+// service holds a single served command: its effective config, and the
+// state derived from that config at startup.  An instance serves either the
+// top-level config at the root, or each entry of Services under
+// /svc/{SvcName}.
+type service struct {
+	configObj	configType
+	path		string	// URL path prefix.  Empty for the top-level service.
+	authKey		string
+	version		string
+	canFile		bool
+	iface		svcInterface
+	reg			*registrar
+	watch		*watcher
+}
+
+// newService checks the given config and applies its defaults, then gets
+// the service ready to serve under the given path, registering it with
+// Piazza where possible.
+func newService(configObj configType, path string) *service {
+	canReg, canFile, hasAuth := checkConfig(&configObj)
+
+	var authKey string
+	if hasAuth {
+		authKey = os.Getenv(configObj.AuthEnVar)
+		if authKey == "" {
+			fmt.Println("Error: no auth key at AuthEnVar.  Registration disabled, and client will have to provide authKey.")
+			hasAuth = false
+			canReg = false
+		}
+	}
+
+	if configObj.MaxTransfers <= 0 {
+		configObj.MaxTransfers = 4
+	}
+	if configObj.InlineMaxKB <= 0 {
+		configObj.InlineMaxKB = 64
+	}
+	if configObj.UploadMaxMB <= 0 {
+		configObj.UploadMaxMB = 100
+	}
+	if configObj.ExtractMaxMB <= 0 {
+		configObj.ExtractMaxMB = 1024
+	}
+	if configObj.Classification == "" {
+		configObj.Classification = "UNCLASSIFIED"
+	}
+	if configObj.Deregister == "" {
+		configObj.Deregister = "offline"
+	}
+	if configObj.RegCheckMins <= 0 {
+		configObj.RegCheckMins = 10
+	}
+	if canReg && configObj.InstanceID == "" {
+		configObj.InstanceID = defaultInstanceID(configObj)
+	}
+	if configObj.Watch != nil && configObj.Watch.IntervalSecs <= 0 {
+		configObj.Watch.IntervalSecs = 60
+	}
+	if configObj.Watch != nil && configObj.Watch.MaxAttempts <= 0 {
+		configObj.Watch.MaxAttempts = 3
+	}
+
+	svc := &service{configObj: configObj, path: path, authKey: authKey, canFile: canFile}
+	svc.version = getVersion(configObj)
+	svc.iface = buildInterface(configObj, path, svc.version, canFile)
+
+	if canReg {
+		fmt.Println("About to manage registration.")
+		svc.reg = newRegistrar(	configObj,
+								configObj.URL + path + "/execute",
+								svc.version,
+								authKey,
+								interfaceAttributes(configObj, svc.iface) )
+		svc.reg.sync()
+		go svc.reg.run()
+		fmt.Println("Registration managed.")
+	}
+	return svc
+}
+
+// serviceConfigs builds the effective config of each entry in Services.  Each
+// entry is laid over the top-level config, so that anything it does not
+// specify is inherited.
+func serviceConfigs(base configType) ([]configType, error) {
+	var configs []configType
+	names := make(map[string]bool)
+	for i, raw := range base.Services {
+		subConfig := base
+		subConfig.Services = nil
+		// maps are merged into by Unmarshal, so each service needs its own.
+		subConfig.Attributes = copyMap(base.Attributes)
+		subConfig.IngestMetadata = copyMap(base.IngestMetadata)
+		// likewise, and watching is never inherited.
+		subConfig.Watch = nil
+
+		err := json.Unmarshal(raw, &subConfig)
+		if err != nil {
+			return nil, fmt.Errorf(`Services entry %d: %s`, i, err.Error())
+		}
+		subConfig.Services = nil
+
+		name := subConfig.SvcName
+		if name == "" || name == base.SvcName || strings.ContainsAny(name, "/?#%") {
+			return nil, fmt.Errorf(`Services entry %d: each service needs its own SvcName, without "/", "?", "#" or "%%".`, i)
+		}
+		if names[name] {
+			return nil, fmt.Errorf(`Services entry %d: SvcName "%s" is used more than once.`, i, name)
+		}
+		names[name] = true
+		configs = append(configs, subConfig)
+	}
+	return configs, nil
+}
+
+// findService picks the service responsible for the given URL path, and
+// returns it along with the remainder of the path.
+func findService(services []*service, path string) (*service, string) {
+	for _, svc := range services {
+		if svc.path == "" {
+			return svc, path
+		}
+		if path == svc.path || strings.HasPrefix(path, svc.path + "/") {
+			return svc, strings.TrimPrefix(path, svc.path)
+		}
+	}
+	return nil, ""
+}
+
+// serve handles the endpoints belonging to a single service.  It returns
+// false if the endpoint is not one of them.
+func (svc *service) serve(w http.ResponseWriter, r *http.Request, subPath string, cache *pzsvc.Cache, runs *runStore, limiter *runLimiter, met *metrics) bool {
+	configObj := svc.configObj
+	switch subPath {
+	case "", "/":
+		fmt.Fprintf(w, "Hello.  This is pzsvc-exec")
+		if configObj.SvcName != "" {
+			fmt.Fprintf(w, ", serving %s", configObj.SvcName)
+		}
+		fmt.Fprintf(w, ".\nWere you possibly looking for the /help or %s/execute endpoints?", svc.path)
+	case "/execute":
+		// the other options are shallow and informational.  This is the
+		// place where the work gets done.
+		output := svc.run(w, r, cache, runs, limiter, met)
+		printJSON(w, output)
+	case "/description":
+		if configObj.Description == "" {
+			fmt.Fprintf(w, "No description defined")
+		} else {
+			fmt.Fprint(w, configObj.Description)
+		}
+	case "/attributes":
+		if configObj.Attributes == nil {
+			fmt.Fprintf(w, "{ }")
+		} else {
+			printJSON(w, configObj.Attributes)
+		}
+	case "/version":
+		fmt.Fprint(w, svc.version)
+	case "/interface":
+		printJSON(w, svc.iface)
+	case "/registration":
+		handleRegistration(w, svc.reg)
+	case "/watch":
+		handleWatch(w, svc.watch)
+	default:
+		return false
+	}
+	return true
+}
+
+// run carries out a single run of the service, within the MaxRuns limit,
+// and records it in the metrics.
+func (svc *service) run(w http.ResponseWriter, r *http.Request, cache *pzsvc.Cache, runs *runStore, limiter *runLimiter, met *metrics) outStruct {
+	limiter.acquire()
+	output := execute(w, r, svc.configObj, svc.authKey, svc.version, svc.canFile, cache, runs)
+	limiter.release()
+	met.observeRun(svc.configObj.SvcName, &output)
+	return output
+}
+
+func copyMap(in map[string]string) map[string]string {
+	if in == nil {
+		return nil
+	}
+	out := make(map[string]string)
+	for key, val := range in {
+		out[key] = val
+	}
+	return out
+}
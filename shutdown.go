@@ -0,0 +1,103 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/venicegeo/pzsvc-exec/pzsvc"
+)
+
+// awaitShutdown blocks until the process receives SIGINT or SIGTERM.  It then
+// stops accepting requests, waits for in-flight runs to finish (up to
+// waitSecs, if set), and takes each service registration out of use as per
+// its Deregister setting.  A second signal during the wait exits
+// immediately.
+func awaitShutdown(server *http.Server, waitSecs int, services []*service) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	fmt.Println("Received " + sig.String() + ".  Waiting for in-flight runs to finish.")
+
+	go func() {
+		<-sigs
+		fmt.Println("Received second signal.  Exiting without cleanup.")
+		os.Exit(1)
+	}()
+
+	ctx := context.Background()
+	if waitSecs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(waitSecs) * time.Second)
+		defer cancel()
+	}
+	// watcher runs don't go through the server, so are waited on separately.
+	var wg sync.WaitGroup
+	for _, svc := range services {
+		if svc.watch != nil {
+			wg.Add(1)
+			go func(wat *watcher) {
+				wat.halt()
+				wg.Done()
+			}(svc.watch)
+		}
+	}
+	err := server.Shutdown(ctx)
+	if err != nil {
+		fmt.Println("error: runs still in flight at shutdown: " + err.Error())
+	}
+	watchDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(watchDone)
+	}()
+	select {
+	case <-watchDone:
+	case <-ctx.Done():
+		fmt.Println("error: watch runs still in flight at shutdown: " + ctx.Err().Error())
+	}
+
+	for _, svc := range services {
+		deregister(svc)
+	}
+}
+
+// deregister stops the registration checks for the service, then deletes or
+// marks it offline in Piazza.
+func deregister(svc *service) {
+	if svc.reg == nil {
+		return
+	}
+	svc.reg.halt()
+	svcID := svc.reg.serviceID()
+	configObj := svc.configObj
+	if svcID == "" || configObj.Deregister == "none" {
+		return
+	}
+	fmt.Println("Deregistering service " + configObj.SvcName + ".")
+	err := pzsvc.DeregisterService(svcID, configObj.PzAddr, svc.authKey, configObj.Deregister == "delete")
+	if err != nil {
+		fmt.Println("error: " + err.Error())
+		return
+	}
+	fmt.Println("Service deregistered.")
+}
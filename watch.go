@@ -0,0 +1,406 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pzsvc-exec/pzsvc"
+)
+
+// watchConfig is the Watch config entry.  When present, the service polls
+// Piazza for data matching the query, and runs its command on each new match
+// as though it had been requested through /execute.
+type watchConfig struct {
+	Keyword			string
+	CreatedBy		string
+	Metadata		map[string]string
+	BBox			[]float64
+	IntervalSecs	int
+	Params			map[string]string
+	StateFile		string
+	Backfill		bool
+	MaxAttempts		int
+}
+
+// watchLookback is how far before the last successful poll each poll reaches
+// back.  Pz stamps createdOn when an ingest starts, which may be well before
+// the resource shows up in listings.
+const watchLookback = 10 * time.Minute
+
+// watcher carries out the polling for a single service, and keeps track of
+// which dataIds have been processed so that each is only run on once.
+type watcher struct {
+	svc			*service
+	query		pzsvc.SearchQuery
+	cache		*pzsvc.Cache
+	runs		*runStore
+	limiter		*runLimiter
+	met			*metrics
+	stop		chan struct{}
+	done		chan struct{}
+
+	mu			sync.Mutex
+	seen		map[string]watchRecord
+	primed		bool
+	since		time.Time	// start of the last successful poll
+	status		watchStatus
+}
+
+// watchRecord is kept for each dataId the watcher has dealt with.  Skipped
+// records are data that were already present when watching began, or that
+// this service produced itself.  Records with Errors are retried until they
+// reach MaxAttempts.
+type watchRecord struct {
+	Time		string		`json:"time"`
+	RunID		string		`json:"runId,omitempty"`
+	Skipped		bool		`json:"skipped,omitempty"`
+	Errors		[]string	`json:"errors,omitempty"`
+	Attempts	int			`json:"attempts,omitempty"`
+}
+
+// watchState is the format of the StateFile.
+type watchState struct {
+	Seen		map[string]watchRecord	`json:"seen"`
+	LastPoll	string					`json:"lastPoll,omitempty"`
+}
+
+// watchStatus is the response to the /watch endpoint.
+type watchStatus struct {
+	Enabled		bool	`json:"enabled"`
+	LastPoll	string	`json:"lastPoll,omitempty"`
+	LastError	string	`json:"lastError,omitempty"`
+	LastDataID	string	`json:"lastDataId,omitempty"`
+	LastRunID	string	`json:"lastRunId,omitempty"`
+	Processed	int		`json:"processed"`
+	Failed		int		`json:"failed"`
+	Retrying	int		`json:"retrying"`
+	Tracked		int		`json:"tracked"`
+}
+
+// newWatcher sets up polling for the service, picking up the record of
+// processed dataIds from StateFile if there is one.
+func newWatcher(svc *service, cache *pzsvc.Cache, runs *runStore, limiter *runLimiter, met *metrics) (*watcher, error) {
+	wConf := svc.configObj.Watch
+	query := pzsvc.SearchQuery{	Keyword: wConf.Keyword,
+								CreatedBy: wConf.CreatedBy,
+								Metadata: wConf.Metadata }
+	if len(wConf.BBox) != 0 {
+		if len(wConf.BBox) != 4 {
+			return nil, fmt.Errorf(`Watch: BBox must be given as [minX, minY, maxX, maxY].`)
+		}
+		query.BBox = &pzsvc.BBox{MinX: wConf.BBox[0], MinY: wConf.BBox[1], MaxX: wConf.BBox[2], MaxY: wConf.BBox[3]}
+	}
+
+	wat := &watcher{	svc: svc,
+						query: query,
+						cache: cache,
+						runs: runs,
+						limiter: limiter,
+						met: met,
+						stop: make(chan struct{}),
+						done: make(chan struct{}),
+						seen: make(map[string]watchRecord),
+						status: watchStatus{Enabled: true} }
+
+	if wConf.StateFile != "" {
+		stateBytes, err := ioutil.ReadFile(wConf.StateFile)
+		if err == nil {
+			var state watchState
+			err = json.Unmarshal(stateBytes, &state)
+			if err != nil {
+				return nil, fmt.Errorf(`Watch: could not read StateFile: %s`, err.Error())
+			}
+			if state.Seen != nil {
+				wat.seen = state.Seen
+			}
+			if state.LastPoll != "" {
+				wat.since, _ = time.Parse(time.RFC3339Nano, state.LastPoll)
+			}
+			// with a record to go on, data that arrived while we were
+			// down is still new.
+			wat.primed = true
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	wat.primed = wat.primed || wConf.Backfill
+	wat.status.Tracked = len(wat.seen)
+	return wat, nil
+}
+
+// run polls every IntervalSecs until halt is called.
+func (wat *watcher) run() {
+	defer close(wat.done)
+	interval := time.Duration(wat.svc.configObj.Watch.IntervalSecs) * time.Second
+	for {
+		wat.poll()
+		select {
+		case <-wat.stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// halt stops polling, waiting for any run in progress to finish.
+func (wat *watcher) halt() {
+	close(wat.stop)
+	<-wat.done
+}
+
+// poll searches for matching data, and runs on each match not seen before,
+// then retries any earlier runs that failed.  On the first poll without
+// Backfill or a StateFile, existing matches are only recorded, so that just
+// data arriving from then on is processed.  After that, only data created
+// since shortly before the last successful poll is listed.
+func (wat *watcher) poll() {
+	configObj := wat.svc.configObj
+	start := time.Now()
+	query := wat.query
+	wat.mu.Lock()
+	if !wat.since.IsZero() {
+		query.CreatedAfter = wat.since.Add(-watchLookback)
+	}
+	wat.mu.Unlock()
+
+	matches, err := pzsvc.SearchData(query, configObj.PzAddr, wat.svc.authKey)
+	now := start.UTC().Format(time.RFC3339)
+	wat.mu.Lock()
+	wat.status.LastPoll = now
+	if err != nil {
+		wat.status.LastError = err.Error()
+		wat.mu.Unlock()
+		fmt.Println("error: watch poll failed: " + err.Error())
+		return
+	}
+	wat.status.LastError = ""
+	primed := wat.primed
+	wat.primed = true
+	wat.mu.Unlock()
+
+	listed := make(map[string]bool)
+	for _, dataRes := range matches {
+		dataID := dataRes.DataID
+		listed[dataID] = true
+		wat.mu.Lock()
+		_, ok := wat.seen[dataID]
+		wat.mu.Unlock()
+		if ok || dataID == "" {
+			continue
+		}
+		algoName, isOutput := dataRes.Metadata.Metadata["algoName"]
+		if !primed || (isOutput && algoName == configObj.SvcName) {
+			wat.record(dataID, watchRecord{Time: now, Skipped: true})
+			continue
+		}
+
+		if wat.stopping() {
+			wat.save()
+			return
+		}
+		wat.process(dataID)
+	}
+
+	for _, dataID := range wat.retries() {
+		if wat.stopping() {
+			break
+		}
+		wat.process(dataID)
+	}
+
+	// only once every match has been dealt with is it safe to stop
+	// listing data from before this poll.
+	wat.mu.Lock()
+	if !wat.stopping() {
+		wat.since = start
+		wat.prune(listed)
+	}
+	wat.mu.Unlock()
+	wat.save()
+}
+
+// prune drops the records that later polls no longer need: those of data
+// dealt with before the earliest createdOn the next poll lists, which this
+// poll did not list either.  Records with attempts left are kept.  Must be
+// called with mu held.
+func (wat *watcher) prune(listed map[string]bool) {
+	cutoff := wat.since.Add(-watchLookback)
+	for dataID, rec := range wat.seen {
+		if listed[dataID] || (len(rec.Errors) != 0 && rec.Attempts < wat.svc.configObj.Watch.MaxAttempts) {
+			continue
+		}
+		recTime, err := time.Parse(time.RFC3339, rec.Time)
+		if err == nil && recTime.Before(cutoff) {
+			delete(wat.seen, dataID)
+		}
+	}
+	wat.status.Tracked = len(wat.seen)
+}
+
+// stopping reports whether halt has been called.
+func (wat *watcher) stopping() bool {
+	select {
+	case <-wat.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// retries returns the dataIds whose runs failed, but have attempts left.
+func (wat *watcher) retries() []string {
+	wat.mu.Lock()
+	defer wat.mu.Unlock()
+	var dataIDs []string
+	for dataID, rec := range wat.seen {
+		if len(rec.Errors) != 0 && rec.Attempts < wat.svc.configObj.Watch.MaxAttempts {
+			dataIDs = append(dataIDs, dataID)
+		}
+	}
+	sort.Strings(dataIDs)
+	return dataIDs
+}
+
+// process runs the service's command on a single dataId, and records the
+// outcome.  The outputs of the run are recorded as well, so that they are
+// never taken for new inputs.
+func (wat *watcher) process(dataID string) {
+	svc := wat.svc
+	wat.mu.Lock()
+	attempts := wat.seen[dataID].Attempts + 1
+	wat.mu.Unlock()
+
+	form := url.Values{}
+	for key, val := range svc.configObj.Watch.Params {
+		form.Set(key, val)
+	}
+	inFiles := dataID
+	if form.Get("inFiles") != "" {
+		inFiles += "," + form.Get("inFiles")
+	}
+	form.Set("inFiles", inFiles)
+
+	fmt.Println("Watch: processing " + dataID + ".")
+	r, err := http.NewRequest("POST", svc.path + "/execute", strings.NewReader(form.Encode()))
+	if err != nil {
+		wat.record(dataID, watchRecord{Time: time.Now().UTC().Format(time.RFC3339), Errors: []string{err.Error()}, Attempts: attempts})
+		return
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.ParseForm()
+
+	output := svc.run(discardWriter{make(http.Header)}, r, wat.cache, wat.runs, wat.limiter, wat.met)
+	if len(output.Errors) != 0 {
+		fmt.Println("Watch: run on " + dataID + " reported errors: " + strings.Join(output.Errors, "  "))
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	wat.record(dataID, watchRecord{Time: now, RunID: output.RunID, Errors: output.Errors, Attempts: attempts})
+	for _, outID := range output.OutFiles {
+		wat.record(outID, watchRecord{Time: now, RunID: output.RunID, Skipped: true})
+	}
+	if output.ProvDataID != "" {
+		wat.record(output.ProvDataID, watchRecord{Time: now, RunID: output.RunID, Skipped: true})
+	}
+
+	wat.mu.Lock()
+	wat.status.LastDataID = dataID
+	wat.status.LastRunID = output.RunID
+	if len(output.Errors) == 0 {
+		wat.status.Processed++
+	} else if attempts >= svc.configObj.Watch.MaxAttempts {
+		wat.status.Failed++
+	}
+	wat.mu.Unlock()
+	wat.save()
+}
+
+func (wat *watcher) record(dataID string, rec watchRecord) {
+	wat.mu.Lock()
+	defer wat.mu.Unlock()
+	wat.seen[dataID] = rec
+	wat.status.Tracked = len(wat.seen)
+}
+
+// save writes the record of processed dataIds to StateFile, if configured.
+// The file is replaced whole, so that a crash never leaves it half written.
+func (wat *watcher) save() {
+	stateFile := wat.svc.configObj.Watch.StateFile
+	if stateFile == "" {
+		return
+	}
+	wat.mu.Lock()
+	state := watchState{Seen: wat.seen}
+	if !wat.since.IsZero() {
+		state.LastPoll = wat.since.UTC().Format(time.RFC3339Nano)
+	}
+	stateBytes, err := json.MarshalIndent(state, "", "  ")
+	wat.mu.Unlock()
+	if err == nil {
+		tmpFile := filepath.Join(filepath.Dir(stateFile), "." + filepath.Base(stateFile) + ".tmp")
+		err = ioutil.WriteFile(tmpFile, stateBytes, 0666)
+		if err == nil {
+			err = os.Rename(tmpFile, stateFile)
+		}
+	}
+	if err != nil {
+		fmt.Println("error: could not save watch state: " + err.Error())
+	}
+}
+
+// handleWatch serves the /watch endpoint, reporting on the watcher's progress.
+func handleWatch(w http.ResponseWriter, wat *watcher) {
+	if wat == nil {
+		printJSON(w, watchStatus{})
+		return
+	}
+	wat.mu.Lock()
+	status := wat.status
+	for _, rec := range wat.seen {
+		if len(rec.Errors) != 0 && rec.Attempts < wat.svc.configObj.Watch.MaxAttempts {
+			status.Retrying++
+		}
+	}
+	wat.mu.Unlock()
+	printJSON(w, status)
+}
+
+// discardWriter is an http.ResponseWriter for runs that have no client to
+// reply to.  Outcomes are taken from the run's output instead.
+type discardWriter struct {
+	header	http.Header
+}
+
+func (dw discardWriter) Header() http.Header {
+	return dw.header
+}
+
+func (dw discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (dw discardWriter) WriteHeader(status int) {
+}